@@ -1,9 +1,31 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
 	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -21,106 +43,3958 @@ type MongoInstance struct {
 
 var mg MongoInstance
 
-// Database settings (insert your own database name and connection URI)
+// Database settings (insert your own database name and connection URI,
+// the URI can also be set through MONGODB_URI)
 const dbName = "go_todos"
 const mongoURI = "mongodb://localhost:27017/" + dbName
 
+// Config contains the settings resolved from the environment at startup.
+//
+// Fields tagged with config:"secret" are never exposed, those tagged with
+// config:"uri" are exposed without their credentials.
+type Config struct {
+	// Port is the port the HTTP server listens on
+	Port string
+	// MongoURI is the connection string of the database
+	MongoURI string `config:"uri"`
+	// AdminEnabled exposes the /admin endpoints
+	AdminEnabled bool
+	// NormalizeText stores a normalized copy of the text and rejects duplicates
+	NormalizeText bool
+	// DefaultPageSize is the number of todos listed when no limit is given
+	DefaultPageSize int64
+	// MaxPageSize caps the number of todos a client can list at once
+	MaxPageSize int64
+	// StrictQuery rejects requests carrying unrecognized query parameters
+	StrictQuery bool
+	// StatsCacheTTL is how long stats responses are cached, 0 disables the cache
+	StatsCacheTTL time.Duration
+	// FieldTimestamps records when each tracked field of a todo last changed
+	FieldTimestamps bool
+	// FeedSize is the number of todos listed in the RSS feed
+	FeedSize int64
+	// Retention is how long completed todos are kept, 0 keeps them forever
+	Retention time.Duration
+	// PurgeInterval is how often completed todos past retention are purged
+	PurgeInterval time.Duration
+	// Timezone is used by the date endpoints when the request has no tz parameter
+	Timezone *time.Location
+	// CompletedLast lists incomplete todos before completed ones by default
+	CompletedLast bool
+	// QueryTimeout bounds how long listing todos may take, 0 means no bound
+	QueryTimeout time.Duration
+	// PartialResults returns the todos fetched so far when listing times out
+	PartialResults bool
+	// CascadeDelete deletes the children of a deleted todo instead of
+	// moving them up to its parent
+	CascadeDelete bool
+	// RetryAfter is the delay suggested to clients when the server is too busy
+	RetryAfter time.Duration
+	// MaxTextLength is the maximum number of characters of a todo's text, 0 disables the limit
+	MaxTextLength int64
+	// TextOverflow is what happens to longer texts: "reject" or "truncate"
+	TextOverflow string
+	// DayStartHour is the hour at which a new day starts for the date endpoints
+	DayStartHour int64
+	// DefaultsFile is the path of the JSON document holding the todo defaults
+	DefaultsFile string
+	// ShutdownTimeout bounds how long in-flight requests are drained on shutdown
+	ShutdownTimeout time.Duration
+	// HideBlocked leaves blocked todos out of the list unless ?blocked= is given
+	HideBlocked bool
+	// StrictTags rejects duplicate tags instead of silently dropping them
+	StrictTags bool
+	// AutoTagRules is the path of the JSON document mapping keywords to tags
+	AutoTagRules string
+	// MaxDBOperations caps the requests using the database at once, 0 disables the cap
+	MaxDBOperations int64
+	// DBWaitTimeout is how long a request waits for its turn before a 503
+	DBWaitTimeout time.Duration
+	// IndexSpecFile is the path of the JSON document listing the indexes to
+	// create instead of the default ones
+	IndexSpecFile string
+}
+
+var config Config
+
+// IndexSpec describes an index of the todos collection in INDEX_SPEC_FILE.
+// The order of a key is 1 or -1, or an index type such as "hashed".
+type IndexSpec struct {
+	Name string `json:"name,omitempty"`
+	Keys []struct {
+		Field string      `json:"field"`
+		Order interface{} `json:"order"`
+	} `json:"keys"`
+	Unique bool `json:"unique,omitempty"`
+	Sparse bool `json:"sparse,omitempty"`
+	// PartialFilterExpression restricts the index to the matching todos,
+	// written as MongoDB extended JSON
+	PartialFilterExpression json.RawMessage `json:"partialFilterExpression,omitempty"`
+}
+
+// AutoTagRule adds Tag to the todos whose text contains Keyword, ignoring case
+type AutoTagRule struct {
+	Keyword string
+	Tag     string
+}
+
+// autoTagRules are loaded from AUTO_TAG_RULES, sorted by keyword
+var autoTagRules []AutoTagRule
+
+// customIndexes replace the default indexes when INDEX_SPEC_FILE is set
+var customIndexes []mongo.IndexModel
+
+// TodoDefaults holds the values given to the fields a client omits when
+// creating a todo, loaded from DEFAULTS_FILE.
+type TodoDefaults struct {
+	Priority  string   `json:"priority,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	Completed bool     `json:"completed,omitempty"`
+}
+
+var defaults TodoDefaults
+
 // Todo struct
+//
+// Fields tagged with api:"readonly" are managed by the server and ignored on writes.
+// Completed is derived from Status, it is only read from clients that send no status.
 type Todo struct {
-	ID        string `json:"id,omitempty" bson:"_id,omitempty"`
-	Text      string `json:"text"`
-	Completed bool   `json:"completed"`
+	ID             string     `json:"id,omitempty" bson:"_id,omitempty" api:"readonly"`
+	Text           string     `json:"text"`
+	NormalizedText string     `json:"normalizedText,omitempty" bson:"normalizedText,omitempty" api:"readonly"`
+	Completed      bool       `json:"completed"`
+	Status         string     `json:"status" bson:"status"`
+	CompletedAt    *time.Time `json:"completedAt,omitempty" bson:"completedAt,omitempty" api:"readonly"`
+	Tags           []string   `json:"tags" bson:"tags"`
+	Priority       string     `json:"priority,omitempty" bson:"priority,omitempty"`
+	DueDate        *time.Time `json:"dueDate,omitempty" bson:"dueDate,omitempty"`
+	Location       *GeoPoint  `json:"location,omitempty" bson:"location,omitempty"`
+	Locked         bool       `json:"locked" bson:"locked" api:"readonly"`
+	Blocked        bool       `json:"blocked" bson:"blocked" api:"readonly"`
+	BlockedReason  string     `json:"blockedReason,omitempty" bson:"blockedReason,omitempty" api:"readonly"`
+	Source         string     `json:"source,omitempty" bson:"source,omitempty"`
+	CreatedAt      *time.Time `json:"createdAt,omitempty" bson:"createdAt,omitempty" api:"readonly"`
+	UpdatedAt      *time.Time `json:"updatedAt,omitempty" bson:"updatedAt,omitempty" api:"readonly"`
+	// FieldUpdatedAt maps each tracked field to its last modification time
+	FieldUpdatedAt map[string]time.Time `json:"fieldUpdatedAt,omitempty" bson:"fieldUpdatedAt,omitempty" api:"readonly"`
+	// ParentID nests the todo under another one, see GET /tree
+	ParentID *primitive.ObjectID `json:"parentId,omitempty" bson:"parentId,omitempty"`
+}
+
+// GeoPoint is a GeoJSON point, its coordinates are [longitude, latitude]
+type GeoPoint struct {
+	Type        string    `json:"type" bson:"type"`
+	Coordinates []float64 `json:"coordinates" bson:"coordinates"`
+}
+
+// The statuses a todo goes through, a done todo is completed
+const (
+	StatusTodo       = "todo"
+	StatusInProgress = "in_progress"
+	StatusDone       = "done"
+)
+
+// statuses are the valid statuses of a todo
+var statuses = []string{StatusTodo, StatusInProgress, StatusDone}
+
+// statusTransitions lists the statuses a todo may move to from each status,
+// a todo has to be started before it can be done. They apply whenever a client
+// names the new status of an existing todo, new todos and PUT /:id bodies only
+// carrying the legacy completed flag may use any status.
+var statusTransitions = map[string][]string{
+	StatusTodo:       {StatusInProgress},
+	StatusInProgress: {StatusTodo, StatusDone},
+	StatusDone:       {StatusTodo, StatusInProgress},
+}
+
+// The sources set by the server on the todos it creates
+const (
+	SourceAPI      = "api"
+	SourceImport   = "import"
+	SourceTemplate = "template"
+)
+
+// trackedFields are the fields recorded in FieldUpdatedAt
+var trackedFields = []string{"text", "completed", "status", "tags", "priority", "dueDate"}
+
+// priorities are the accepted priority levels, from lowest to highest
+var priorities = []string{"low", "medium", "high"}
+
+// exportVersion is the version of the single todo export format
+const exportVersion = 1
+
+// TodoExport is the self-contained representation of a single todo,
+// suitable for re-importing it elsewhere
+type TodoExport struct {
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exportedAt"`
+	Todo       Todo      `json:"todo"`
+}
+
+// Template is a reusable set of todos
+type Template struct {
+	ID    string         `json:"id,omitempty" bson:"_id,omitempty" api:"readonly"`
+	Name  string         `json:"name"`
+	Items []TemplateItem `json:"items" bson:"items"`
+}
+
+// TemplateItem describes a todo created when instantiating a Template.
+// DueIn is an offset relative to the instantiation time such as "2h" or "3d".
+type TemplateItem struct {
+	Text  string   `json:"text"`
+	Tags  []string `json:"tags" bson:"tags"`
+	DueIn string   `json:"dueIn,omitempty" bson:"dueIn,omitempty"`
+}
+
+// responseCache is a small in-memory TTL cache of response bodies
+type responseCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedResponse
+}
+
+type cachedResponse struct {
+	body        []byte
+	contentType string
+	etag        string
+	expires     time.Time
+}
+
+var statsCache = responseCache{entries: map[string]cachedResponse{}}
+
+func (rc *responseCache) get(key string) (cachedResponse, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	entry, ok := rc.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		delete(rc.entries, key)
+		return cachedResponse{}, false
+	}
+	return entry, true
+}
+
+func (rc *responseCache) set(key string, entry cachedResponse) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.entries[key] = entry
+}
+
+// clear drops every entry, it is called whenever the todos change
+func (rc *responseCache) clear() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.entries = map[string]cachedResponse{}
+}
+
+// MergeRequest lists the todos folded into the kept one by POST /merge
+type MergeRequest struct {
+	Keep   string   `json:"keep"`
+	Remove []string `json:"remove"`
+}
+
+// maxBulkStatus caps the number of todos moved by a single POST /bulk-status
+const maxBulkStatus = 100
+
+// BulkStatusRequest moves the listed todos to Status through POST /bulk-status
+type BulkStatusRequest struct {
+	IDs    []string `json:"ids"`
+	Status string   `json:"status"`
+}
+
+// BulkStatusResult is the outcome of moving one todo, Error tells why it failed
+type BulkStatusResult struct {
+	ID    string `json:"id"`
+	OK    bool   `json:"ok"`
+	Todo  *Todo  `json:"todo,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// TagRenameRequest renames the From tag to To through POST /tags/rename
+type TagRenameRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// ScoredTodo is a todo along with its urgency, see urgencyScore
+type ScoredTodo struct {
+	Todo    `bson:",inline"`
+	Urgency float64 `json:"urgency" bson:"urgency"`
+}
+
+// SearchResult is a todo found by GET /search/all, MatchedIn lists the
+// fields that matched: "text" and/or "tags"
+type SearchResult struct {
+	Todo
+	MatchedIn []string `json:"matchedIn"`
+}
+
+// RescheduleRequest moves overdue todos either to an absolute date (To) or
+// to an offset from now (By), such as "24h" or "1d"
+type RescheduleRequest struct {
+	To *time.Time `json:"to"`
+	By string     `json:"by"`
+}
+
+// RSS is an RSS 2.0 document
+type RSS struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel RSSChannel `xml:"channel"`
+}
+
+// RSSChannel is the channel of an RSS 2.0 document
+type RSSChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []RSSItem `xml:"item"`
+}
+
+// RSSItem is a single todo in the RSS feed
+type RSSItem struct {
+	Title       string  `xml:"title"`
+	Description string  `xml:"description"`
+	PubDate     string  `xml:"pubDate"`
+	GUID        RSSGUID `xml:"guid"`
+}
+
+// RSSGUID identifies an RSS item, todo IDs are not links
+type RSSGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// maxNamedCounts caps the number of filters counted by a single POST /counts
+const maxNamedCounts = 50
+
+// NamedCount is one of the filters counted by POST /counts, its values use the
+// same whitelisted keys as the list endpoint's query parameters
+type NamedCount struct {
+	Name   string                 `json:"name"`
+	Filter map[string]interface{} `json:"filter"`
+}
+
+// TreeNode is a todo along with the todos nested under it
+type TreeNode struct {
+	Todo
+	Children []*TreeNode `json:"children"`
+}
+
+// maxTreeDepth bounds how deep todos can be nested
+const maxTreeDepth = 100
+
+// FieldSchema describes a single JSON field of a model
+type FieldSchema struct {
+	Name     string       `json:"name"`
+	Type     string       `json:"type"`
+	Format   string       `json:"format,omitempty"`
+	Items    *FieldSchema `json:"items,omitempty"`
+	Nullable bool         `json:"nullable"`
+	Optional bool         `json:"optional"`
+	ReadOnly bool         `json:"readOnly"`
+}
+
+// LoadConfig reads the application settings from environment variables.
+func LoadConfig() {
+	config = Config{
+		Port:            envString("PORT", "4242"),
+		MongoURI:        envString("MONGODB_URI", mongoURI),
+		AdminEnabled:    envBool("ADMIN_ENABLED", false),
+		NormalizeText:   envBool("NORMALIZE_TEXT", false),
+		DefaultPageSize: envInt("DEFAULT_PAGE_SIZE", 20),
+		MaxPageSize:     envInt("MAX_PAGE_SIZE", 100),
+		StrictQuery:     envBool("STRICT_QUERY", false),
+		StatsCacheTTL:   envDuration("STATS_CACHE_TTL", 10*time.Second),
+		FieldTimestamps: envBool("FIELD_TIMESTAMPS", false),
+		FeedSize:        envInt("FEED_SIZE", 20),
+		Retention:       envDuration("RETENTION_PERIOD", 0),
+		PurgeInterval:   envDuration("PURGE_INTERVAL", time.Hour),
+		CompletedLast:   envBool("COMPLETED_LAST", false),
+		QueryTimeout:    envDuration("QUERY_TIMEOUT", 0),
+		PartialResults:  envBool("PARTIAL_RESULTS", false),
+		CascadeDelete:   envBool("CASCADE_DELETE", false),
+		RetryAfter:      envDuration("RETRY_AFTER", 5*time.Second),
+		MaxTextLength:   envInt("MAX_TEXT_LENGTH", 0),
+		TextOverflow:    envString("TEXT_OVERFLOW", "reject"),
+		DayStartHour:    envInt("DAY_START_HOUR", 0),
+		DefaultsFile:    envString("DEFAULTS_FILE", ""),
+		ShutdownTimeout: envDuration("SHUTDOWN_TIMEOUT", 15*time.Second),
+		HideBlocked:     envBool("HIDE_BLOCKED", false),
+		IndexSpecFile:   envString("INDEX_SPEC_FILE", ""),
+		AutoTagRules:    envString("AUTO_TAG_RULES", ""),
+		StrictTags:      envBool("STRICT_TAGS", false),
+		MaxDBOperations: envInt("MAX_DB_OPERATIONS", 0),
+		DBWaitTimeout:   envDuration("DB_WAIT_TIMEOUT", 100*time.Millisecond),
+	}
+
+	if config.MaxDBOperations > 0 {
+		dbSlots = make(chan struct{}, config.MaxDBOperations)
+	}
+
+	if config.AutoTagRules != "" {
+		rules, err := loadAutoTagRules(config.AutoTagRules)
+		if err != nil {
+			log.Fatalf("invalid AUTO_TAG_RULES %q: %v", config.AutoTagRules, err)
+		}
+		autoTagRules = rules
+		log.Printf("Loaded %d auto tagging rules from %s", len(rules), config.AutoTagRules)
+	}
+
+	if config.IndexSpecFile != "" {
+		indexes, err := loadIndexSpecs(config.IndexSpecFile)
+		if err != nil {
+			log.Fatalf("invalid INDEX_SPEC_FILE %q: %v", config.IndexSpecFile, err)
+		}
+		customIndexes = indexes
+	}
+
+	if config.DefaultsFile != "" {
+		loaded, err := loadDefaults(config.DefaultsFile)
+		if err != nil {
+			log.Fatalf("invalid DEFAULTS_FILE %q: %v", config.DefaultsFile, err)
+		}
+		defaults = loaded
+		log.Printf("Loaded todo defaults from %s", config.DefaultsFile)
+	}
+
+	if config.DayStartHour < 0 || config.DayStartHour > 23 {
+		log.Fatalf("invalid DAY_START_HOUR %d: must be between 0 and 23", config.DayStartHour)
+	}
+
+	if config.TextOverflow != "reject" && config.TextOverflow != "truncate" {
+		log.Fatalf("invalid TEXT_OVERFLOW %q: must be reject or truncate", config.TextOverflow)
+	}
+
+	// an invalid timezone would silently shift every date query, so fail fast
+	config.Timezone = time.UTC
+	if name := strings.TrimSpace(os.Getenv("TZ")); name != "" {
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			log.Fatalf("invalid TZ %q: %v", name, err)
+		}
+		config.Timezone = loc
+	}
+
+	// the default page size can never exceed what a client may ask for
+	if config.MaxPageSize < 1 {
+		config.MaxPageSize = 100
+	}
+	if config.DefaultPageSize < 1 {
+		config.DefaultPageSize = 20
+	}
+	if config.DefaultPageSize > config.MaxPageSize {
+		config.DefaultPageSize = config.MaxPageSize
+	}
+	log.Printf("Listing %d todos per page by default (max %d)", config.DefaultPageSize, config.MaxPageSize)
+
+	// a zero limit would put the whole collection in the feed
+	if config.FeedSize < 1 {
+		config.FeedSize = 20
+	}
+}
+
+// loadDefaults reads and validates the todo defaults document at path,
+// rejecting unknown fields so that typos don't go unnoticed.
+func loadDefaults(path string) (TodoDefaults, error) {
+	var loaded TodoDefaults
+	file, err := os.Open(path)
+	if err != nil {
+		return loaded, err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&loaded); err != nil {
+		return loaded, err
+	}
+	if loaded.Priority != "" && !validPriority(loaded.Priority) {
+		return loaded, fmt.Errorf("priority must be one of %s", strings.Join(priorities, ", "))
+	}
+	loaded.Tags = sanitizeTags(loaded.Tags)
+	return loaded, nil
+}
+
+// loadIndexSpecs reads the index specs at path into index models, rejecting
+// unknown fields and invalid keys.
+func loadIndexSpecs(path string) ([]mongo.IndexModel, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var specs []IndexSpec
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&specs); err != nil {
+		return nil, err
+	}
+
+	indexes := make([]mongo.IndexModel, 0, len(specs))
+	for i, spec := range specs {
+		if len(spec.Keys) == 0 {
+			return nil, fmt.Errorf("index %d has no keys", i)
+		}
+		keys := bson.D{}
+		for _, key := range spec.Keys {
+			if key.Field == "" {
+				return nil, fmt.Errorf("index %d has a key without a field", i)
+			}
+			switch order := key.Order.(type) {
+			case float64:
+				if order != 1 && order != -1 {
+					return nil, fmt.Errorf("index %d: the order of %s must be 1 or -1", i, key.Field)
+				}
+				keys = append(keys, bson.E{Key: key.Field, Value: int32(order)})
+			case string:
+				if order != "2dsphere" && order != "text" && order != "hashed" {
+					return nil, fmt.Errorf("index %d: unsupported index type %q", i, order)
+				}
+				keys = append(keys, bson.E{Key: key.Field, Value: order})
+			default:
+				return nil, fmt.Errorf("index %d: the order of %s must be 1, -1 or an index type", i, key.Field)
+			}
+		}
+
+		opts := options.Index().SetUnique(spec.Unique).SetSparse(spec.Sparse)
+		if spec.Name != "" {
+			opts.SetName(spec.Name)
+		}
+		if len(spec.PartialFilterExpression) > 0 {
+			var filter bson.D
+			if err := bson.UnmarshalExtJSON(spec.PartialFilterExpression, false, &filter); err != nil {
+				return nil, fmt.Errorf("index %d: invalid partialFilterExpression: %v", i, err)
+			}
+			opts.SetPartialFilterExpression(filter)
+		}
+		indexes = append(indexes, mongo.IndexModel{Keys: keys, Options: opts})
+	}
+	return indexes, nil
 }
 
-// Connect configures the MongoDB client and initializes the database connection.
-// Source: https://www.mongodb.com/blog/post/quick-start-golang--mongodb--starting-and-setup
-func Connect() error {
-	client, err := mongo.NewClient(options.Client().ApplyURI(mongoURI))
+// loadAutoTagRules reads the {"keyword": "tag"} document at path. Keywords
+// are matched in lowercase, in alphabetical order so that the tags added
+// don't depend on the document's order.
+func loadAutoTagRules(path string) ([]AutoTagRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var mappings map[string]string
+	if err := json.Unmarshal(data, &mappings); err != nil {
+		return nil, err
+	}
+
+	rules := make([]AutoTagRule, 0, len(mappings))
+	for keyword, tag := range mappings {
+		keyword, tag = strings.ToLower(strings.TrimSpace(keyword)), strings.TrimSpace(tag)
+		if keyword == "" || tag == "" {
+			return nil, errors.New("keywords and tags must not be empty")
+		}
+		rules = append(rules, AutoTagRule{Keyword: keyword, Tag: tag})
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Keyword < rules[j].Keyword })
+	return rules, nil
+}
+
+// autoTags returns the tags of the auto tagging rules matching text.
+func autoTags(text string) []string {
+	text = strings.ToLower(text)
+	var tags []string
+	for _, rule := range autoTagRules {
+		if strings.Contains(text, rule.Keyword) {
+			tags = append(tags, rule.Tag)
+		}
+	}
+	return tags
+}
+
+// newTodo returns a todo holding the configured defaults, to be overwritten
+// by the fields present in the request body.
+func newTodo() *Todo {
+	return &Todo{
+		Priority:  defaults.Priority,
+		Tags:      append([]string(nil), defaults.Tags...),
+		Completed: defaults.Completed,
+	}
+}
+
+// effectiveConfig describes the resolved configuration, keyed by the
+// lowerCamelCase field names, with secrets and credentials redacted, along
+// with the database name.
+func effectiveConfig() fiber.Map {
+	value := reflect.ValueOf(config)
+	t := value.Type()
+	effective := make(fiber.Map, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.ToLower(field.Name[:1]) + field.Name[1:]
+
+		switch v := value.Field(i).Interface().(type) {
+		case string:
+			switch field.Tag.Get("config") {
+			case "secret":
+				if v != "" {
+					v = "[redacted]"
+				}
+			case "uri":
+				if u, err := url.Parse(v); err == nil {
+					v = u.Redacted()
+				} else {
+					v = "[redacted]"
+				}
+			}
+			effective[name] = v
+		case time.Duration:
+			effective[name] = v.String()
+		case *time.Location:
+			effective[name] = v.String()
+		default:
+			effective[name] = v
+		}
+	}
+	// the database name is fixed at build time rather than configured
+	effective["dbName"] = dbName
+	return effective
+}
+
+// requireAdmin hides the admin endpoints unless ADMIN_ENABLED is set.
+func requireAdmin(c *fiber.Ctx) error {
+	if !config.AdminEnabled {
+		return c.SendStatus(404)
+	}
+	return c.Next()
+}
+
+// envString returns the value of the given environment variable,
+// falling back to def when it is unset.
+func envString(key, def string) string {
+	if value := strings.TrimSpace(os.Getenv(key)); value != "" {
+		return value
+	}
+	return def
+}
+
+// envBool returns the boolean value of the given environment variable,
+// falling back to def when it is unset or cannot be parsed.
+func envBool(key string, def bool) bool {
+	switch strings.ToLower(strings.TrimSpace(os.Getenv(key))) {
+	case "1", "true", "yes", "on":
+		return true
+	case "0", "false", "no", "off":
+		return false
+	}
+	return def
+}
+
+// envInt returns the integer value of the given environment variable,
+// falling back to def when it is unset or cannot be parsed.
+func envInt(key string, def int64) int64 {
+	value, err := strconv.ParseInt(strings.TrimSpace(os.Getenv(key)), 10, 64)
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// envDuration returns the duration value of the given environment variable,
+// such as "90s" or "30d", falling back to def when it is unset or cannot be parsed.
+func envDuration(key string, def time.Duration) time.Duration {
+	value, err := parseOffset(strings.TrimSpace(os.Getenv(key)))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// queryOffset parses the "offset" query parameter, defaulting to 0.
+func queryOffset(c *fiber.Ctx) (int64, error) {
+	raw := c.Query("offset")
+	if raw == "" {
+		return 0, nil
+	}
+	offset, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, fiber.NewError(400, "offset must be a non-negative integer")
+	}
+	return offset, nil
+}
+
+// queryLimit parses the "limit" query parameter, returning def when it is
+// omitted and capping it at max.
+func queryLimit(c *fiber.Ctx, def, max int64) (int64, error) {
+	raw := c.Query("limit")
+	if raw == "" {
+		return def, nil
+	}
+	limit, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || limit < 1 {
+		return 0, fiber.NewError(400, "limit must be a positive integer")
+	}
+	if limit > max {
+		limit = max
+	}
+	return limit, nil
+}
+
+// sanitizeTags trims the given tags and removes empty and duplicate entries,
+// always returning a non-nil slice.
+func sanitizeTags(tags []string) []string {
+	seen := make(map[string]bool, len(tags))
+	clean := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		clean = append(clean, tag)
+	}
+	return clean
+}
+
+// allowQuery returns a middleware that, in strict mode, rejects requests
+// using query parameters other than the given ones with a 400 naming them.
+func allowQuery(params ...string) fiber.Handler {
+	allowed := make(map[string]bool, len(params)+len(globalParams))
+	for _, param := range append(params, globalParams...) {
+		allowed[param] = true
+	}
+
+	return func(c *fiber.Ctx) error {
+		if !config.StrictQuery {
+			return c.Next()
+		}
+
+		var unknown []string
+		c.Context().QueryArgs().VisitAll(func(key, _ []byte) {
+			if !allowed[string(key)] {
+				unknown = append(unknown, string(key))
+			}
+		})
+		if len(unknown) > 0 {
+			return fiber.NewError(400, "unknown query parameters: "+strings.Join(unknown, ", "))
+		}
+		return c.Next()
+	}
+}
+
+// globalParams are the query parameters every endpoint accepts
+var globalParams = []string{"timeFormat"}
+
+// timeFields are the JSON fields holding times, or maps of times such as
+// fieldUpdatedAt, in the responses
+var timeFields = map[string]bool{
+	"dueDate":        true,
+	"completedAt":    true,
+	"createdAt":      true,
+	"updatedAt":      true,
+	"exportedAt":     true,
+	"fieldUpdatedAt": true,
+}
+
+// formatTimes rewrites the times of JSON responses as milliseconds since the
+// epoch when the request has ?timeFormat=epochMillis. The default, rfc3339,
+// leaves the responses untouched. Streamed responses are not rewritten.
+func formatTimes(c *fiber.Ctx) error {
+	switch c.Query("timeFormat", "rfc3339") {
+	case "rfc3339":
+		return c.Next()
+	case "epochMillis":
+	default:
+		return fiber.NewError(400, "timeFormat must be rfc3339 or epochMillis")
+	}
+
+	if err := c.Next(); err != nil {
+		return err
+	}
+	response := c.Response()
+	if response.IsBodyStream() || !strings.HasPrefix(string(response.Header.ContentType()), fiber.MIMEApplicationJSON) {
+		return nil
+	}
+
+	// numbers are kept as is rather than going through float64
+	decoder := json.NewDecoder(bytes.NewReader(response.Body()))
+	decoder.UseNumber()
+	var body interface{}
+	if err := decoder.Decode(&body); err != nil {
+		return nil
+	}
+	converted, err := json.Marshal(epochMillis(body, false))
+	if err != nil {
+		return err
+	}
+	response.SetBodyRaw(converted)
+	return nil
+}
+
+// epochMillis replaces the RFC 3339 times found under the timeFields of a
+// decoded JSON value with milliseconds since the epoch. isTime tells whether
+// the value itself sits under one of them.
+func epochMillis(value interface{}, isTime bool) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if isTime {
+				v[key] = epochMillis(child, true)
+			} else {
+				v[key] = epochMillis(child, timeFields[key])
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = epochMillis(child, false)
+		}
+	case string:
+		if isTime {
+			if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+				return t.UnixMilli()
+			}
+		}
+	}
+	return value
+}
+
+// cacheStats serves repeated stats requests from the stats cache, keyed by
+// the full request URL. The X-Cache header tells whether the cache was hit.
+func cacheStats(c *fiber.Ctx) error {
+	if config.StatsCacheTTL <= 0 || c.Method() != fiber.MethodGet {
+		return c.Next()
+	}
+
+	// the URL points into the reused request buffer, the key outlives it
+	key := string([]byte(c.OriginalURL()))
+	if entry, ok := statsCache.get(key); ok {
+		c.Set("X-Cache", "HIT")
+		c.Set(fiber.HeaderContentType, entry.contentType)
+		return c.Send(entry.body)
+	}
+
+	c.Set("X-Cache", "MISS")
+	if err := c.Next(); err != nil {
+		return err
+	}
+	if c.Response().StatusCode() == 200 {
+		statsCache.set(key, cachedResponse{
+			body:        append([]byte(nil), c.Response().Body()...),
+			contentType: string(c.Response().Header.ContentType()),
+			etag:        string(c.Response().Header.Peek(fiber.HeaderETag)),
+			expires:     time.Now().Add(config.StatsCacheTTL),
+		})
+	}
+	return nil
+}
+
+// statsETag tags stats responses with a weak ETag derived from the collection
+// checksum and answers 304 when the client's If-None-Match still matches it.
+func statsETag(c *fiber.Ctx) error {
+	if c.Method() != fiber.MethodGet {
+		return c.Next()
+	}
+
+	// a cached response comes with its ETag, saving the checksum aggregation
+	etag := ""
+	if entry, ok := statsCache.get(c.OriginalURL()); ok {
+		etag = entry.etag
+	}
+	if etag == "" {
+		checksum, err := collectionChecksum(c.Context())
+		if err != nil {
+			// the stats can still be served, just not conditionally
+			return c.Next()
+		}
+		etag = `W/"` + checksum + `"`
+	}
+	c.Set(fiber.HeaderETag, etag)
+	if etagMatches(c.Get(fiber.HeaderIfNoneMatch), etag) {
+		return c.SendStatus(304)
+	}
+
+	err := c.Next()
+	// only successful stats can be revalidated, errors are answered later on
+	if err != nil || c.Response().StatusCode() != 200 {
+		c.Response().Header.Del(fiber.HeaderETag)
+	}
+	return err
+}
+
+// etagMatches reports whether an If-None-Match header lists the given ETag,
+// using the weak comparison of RFC 9110.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// utf8BOM is the byte order mark some clients prepend to UTF-8 bodies
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// trimBody strips a leading byte order mark and the surrounding whitespace
+// from the request body, which the JSON body parser would otherwise reject.
+func trimBody(c *fiber.Ctx) error {
+	body := c.Body()
+	trimmed := bytes.TrimSpace(bytes.TrimPrefix(body, utf8BOM))
+	if len(trimmed) != len(body) {
+		c.Request().SetBody(trimmed)
+	}
+	return c.Next()
+}
+
+// dbSlots holds a token per request using the database, nil when unbounded
+var dbSlots chan struct{}
+
+// limitDB bounds the number of requests using the database at once, so that
+// bursts queue here rather than on the database. A request that can't get a
+// slot within DB_WAIT_TIMEOUT is answered with a 503. Requests running several
+// operations in parallel take a slot for each extra one, see tryAcquireDB.
+// Streamed responses give their slot back once the stream starts.
+func limitDB(c *fiber.Ctx) error {
+	if dbSlots == nil {
+		return c.Next()
+	}
+
+	// a free slot is taken before racing the timer, which a zero
+	// DB_WAIT_TIMEOUT would otherwise win half of the time
+	if !tryAcquireDB() {
+		timer := time.NewTimer(config.DBWaitTimeout)
+		defer timer.Stop()
+		select {
+		case dbSlots <- struct{}{}:
+		case <-timer.C:
+			return retryLater(c, 503, "Too many concurrent database operations")
+		}
+	}
+	defer releaseDB()
+	return c.Next()
+}
+
+// tryAcquireDB takes an extra database slot for a request running several
+// operations at once, without waiting. It always succeeds when unbounded.
+func tryAcquireDB() bool {
+	if dbSlots == nil {
+		return true
+	}
+	select {
+	case dbSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// releaseDB gives back a slot taken by tryAcquireDB.
+func releaseDB() {
+	if dbSlots != nil {
+		<-dbSlots
+	}
+}
+
+// invalidateOnWrite clears the cached stats after every successful write.
+func invalidateOnWrite(c *fiber.Ctx) error {
+	err := c.Next()
+	if c.Method() != fiber.MethodGet && c.Method() != fiber.MethodHead && c.Response().StatusCode() < 400 {
+		statsCache.clear()
+	}
+	return err
+}
+
+// ifUnmodifiedSince parses the If-Unmodified-Since request header. A missing
+// or malformed header is ignored, as required by RFC 9110, and yields nil.
+func ifUnmodifiedSince(c *fiber.Ctx) *time.Time {
+	since, err := http.ParseTime(c.Get("If-Unmodified-Since"))
+	if err != nil {
+		return nil
+	}
+	return &since
+}
+
+// describeModel builds the schema of a struct's JSON fields from its tags.
+func describeModel(model interface{}) []FieldSchema {
+	t := reflect.TypeOf(model)
+	fields := make([]FieldSchema, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		schema := describeType(field.Type)
+		schema.Name = name
+		schema.Optional = strings.Contains(opts, "omitempty")
+		schema.ReadOnly = field.Tag.Get("api") == "readonly"
+		fields = append(fields, schema)
+	}
+	return fields
+}
+
+// describeType maps a Go type onto its JSON type.
+func describeType(t reflect.Type) FieldSchema {
+	schema := FieldSchema{}
+	if t.Kind() == reflect.Ptr {
+		schema.Nullable = true
+		t = t.Elem()
+	}
+
+	switch {
+	case t == reflect.TypeOf(time.Time{}):
+		schema.Type = "string"
+		schema.Format = "date-time"
+	case t == reflect.TypeOf(primitive.ObjectID{}):
+		schema.Type = "string"
+		schema.Format = "objectid"
+	case t.Kind() == reflect.String:
+		schema.Type = "string"
+	case t.Kind() == reflect.Bool:
+		schema.Type = "boolean"
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		schema.Type = "integer"
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		schema.Type = "number"
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		schema.Type = "array"
+		items := describeType(t.Elem())
+		schema.Items = &items
+	default:
+		schema.Type = "object"
+	}
+	return schema
+}
+
+// resolveTimezone returns the timezone date endpoints interpret "today" and
+// plain dates in: the request's tz parameter, then the TZ environment
+// variable, then UTC.
+func resolveTimezone(c *fiber.Ctx) (*time.Location, error) {
+	name := c.Query("tz")
+	if name == "" {
+		return config.Timezone, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil || name == "Local" {
+		return nil, fiber.NewError(400, "tz must be an IANA timezone such as Europe/Paris")
+	}
+	return loc, nil
+}
+
+// startOfDay returns the start of the day containing t in the given timezone.
+// Days start at DAY_START_HOUR, so with a value of 4 anything before 4am
+// still belongs to the previous day.
+func startOfDay(t time.Time, loc *time.Location) time.Time {
+	local := t.In(loc)
+	start := time.Date(local.Year(), local.Month(), local.Day(), int(config.DayStartHour), 0, 0, 0, loc)
+	if local.Before(start) {
+		start = start.AddDate(0, 0, -1)
+	}
+	return start
+}
+
+// queryTime parses an optional date query parameter, either an RFC 3339
+// timestamp or a plain date ("2006-01-02") taken in the given timezone. A plain
+// date stands for the start of that day, at DAY_START_HOUR.
+func queryTime(c *fiber.Ctx, key string, loc *time.Location) (*time.Time, error) {
+	raw := c.Query(key)
+	if raw == "" {
+		return nil, nil
+	}
+	value, err := time.Parse(time.RFC3339, raw)
+	if err == nil {
+		return &value, nil
+	}
+	day, err := time.ParseInLocation("2006-01-02", raw, loc)
+	if err != nil {
+		return nil, fiber.NewError(400, key+" must be an RFC 3339 timestamp or a date")
+	}
+	value = time.Date(day.Year(), day.Month(), day.Day(), int(config.DayStartHour), 0, 0, 0, loc)
+	return &value, nil
+}
+
+// queryRange parses the "from" and "to" date query parameters into a range
+// condition on a date field. A plain "to" date includes the whole day.
+func queryRange(c *fiber.Ctx, loc *time.Location) (bson.D, error) {
+	from, err := queryTime(c, "from", loc)
+	if err != nil {
+		return nil, err
+	}
+	to, err := queryTime(c, "to", loc)
+	if err != nil {
+		return nil, err
+	}
+	if to != nil && !strings.Contains(c.Query("to"), "T") {
+		end := to.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		to = &end
+	}
+	if from != nil && to != nil && from.After(*to) {
+		return nil, fiber.NewError(400, "from must not be after to")
+	}
+
+	condition := bson.D{{Key: "$exists", Value: true}}
+	if from != nil {
+		condition = append(condition, bson.E{Key: "$gte", Value: *from})
+	}
+	if to != nil {
+		condition = append(condition, bson.E{Key: "$lte", Value: *to})
+	}
+	return condition, nil
+}
+
+// parseOffset parses a relative offset, accepting Go durations ("90m", "2h")
+// as well as a whole number of days ("3d").
+func parseOffset(offset string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(offset, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(offset)
+}
+
+// validateTemplate checks that a template can be instantiated. Item texts
+// longer than MAX_TEXT_LENGTH are rejected or truncated like todo texts.
+func validateTemplate(c *fiber.Ctx, template *Template) error {
+	if strings.TrimSpace(template.Name) == "" {
+		return fiber.NewError(422, "name is required")
+	}
+	for i, item := range template.Items {
+		if strings.TrimSpace(item.Text) == "" {
+			return fiber.NewError(422, fmt.Sprintf("items[%d].text is required", i))
+		}
+		if config.MaxTextLength > 0 && int64(utf8.RuneCountInString(item.Text)) > config.MaxTextLength {
+			if config.TextOverflow != "truncate" {
+				return fiber.NewError(422, fmt.Sprintf("items[%d].text must be at most %d characters", i, config.MaxTextLength))
+			}
+			template.Items[i].Text = string([]rune(item.Text)[:config.MaxTextLength])
+			c.Append("X-Truncated-Field", fmt.Sprintf("items[%d].text", i))
+		}
+		if item.DueIn != "" {
+			if _, err := parseOffset(item.DueIn); err != nil {
+				return fiber.NewError(422, fmt.Sprintf("items[%d].dueIn is not a valid offset", i))
+			}
+		}
+		if tag := duplicateTag(item.Tags); config.StrictTags && tag != "" {
+			return fiber.NewError(422, fmt.Sprintf("items[%d].tags contains %q more than once", i, tag))
+		}
+	}
+	return nil
+}
+
+// duplicateTag returns the first tag appearing twice, once trimmed, or "".
+func duplicateTag(tags []string) string {
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if seen[tag] {
+			return tag
+		}
+		seen[tag] = true
+	}
+	return ""
+}
+
+// validPriority reports whether the given priority is one of the accepted levels.
+func validPriority(priority string) bool {
+	for _, level := range priorities {
+		if priority == level {
+			return true
+		}
+	}
+	return false
+}
+
+// validStatus reports whether status is one of the statuses.
+func validStatus(status string) bool {
+	for _, s := range statuses {
+		if status == s {
+			return true
+		}
+	}
+	return false
+}
+
+// canTransition reports whether a todo may move from one status to another,
+// staying in the same status is always allowed.
+func canTransition(from, to string) bool {
+	if from == to {
+		return true
+	}
+	for _, status := range statusTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+// syncStatus derives the status of a todo from its completed flag when the
+// client sent no status, then keeps the flag in sync with the status. An
+// existing todo, passed as current, keeps its status unless the flag changed.
+func syncStatus(todo, current *Todo) {
+	if todo.Status == "" {
+		switch {
+		case current != nil && todo.Completed == current.Completed:
+			todo.Status = current.Status
+		case todo.Completed:
+			todo.Status = StatusDone
+		default:
+			todo.Status = StatusTodo
+		}
+	}
+	todo.Completed = todo.Status == StatusDone
+}
+
+// statusUpdate builds the update pipeline moving a todo to the given status,
+// keeping completed and completedAt in sync with it.
+func statusUpdate(status string, now time.Time) mongo.Pipeline {
+	// the completion time is only stamped the first time the todo is done
+	var completedAt interface{} = "$$REMOVE"
+	if status == StatusDone {
+		completedAt = bson.D{{Key: "$ifNull", Value: bson.A{"$completedAt", now}}}
+	}
+	fields := bson.D{
+		{Key: "status", Value: status},
+		{Key: "completed", Value: status == StatusDone},
+		{Key: "completedAt", Value: completedAt},
+		{Key: "updatedAt", Value: now},
+	}
+	if config.FieldTimestamps {
+		stamp := func(field string, value interface{}) bson.E {
+			return bson.E{Key: "fieldUpdatedAt." + field, Value: bson.D{{Key: "$cond", Value: bson.A{
+				bson.D{{Key: "$ne", Value: bson.A{"$" + field, value}}}, now, "$fieldUpdatedAt." + field,
+			}}}}
+		}
+		// the expressions of a stage see the todo as it was before the stage
+		fields = append(fields, stamp("status", status), stamp("completed", status == StatusDone))
+	}
+	return mongo.Pipeline{{{Key: "$set", Value: fields}}}
+}
+
+// urgencyScore builds the aggregation expression ranking todos in GET /inbox:
+//
+//	urgency = 10 × priority + due
+//
+// where priority is 3 for high, 2 for medium and 1 for low or no priority, and
+// due is 14 minus the number of days until the due date, bounded to [0, 28]:
+// 0 for todos due in two weeks or more or without a due date, 14 for todos due
+// now and 28 for todos overdue by two weeks or more.
+func urgencyScore(now time.Time) bson.D {
+	weight := bson.D{{Key: "$switch", Value: bson.D{
+		{Key: "branches", Value: bson.A{
+			bson.D{{Key: "case", Value: bson.D{{Key: "$eq", Value: bson.A{"$priority", "high"}}}}, {Key: "then", Value: 3}},
+			bson.D{{Key: "case", Value: bson.D{{Key: "$eq", Value: bson.A{"$priority", "medium"}}}}, {Key: "then", Value: 2}},
+		}},
+		{Key: "default", Value: 1},
+	}}}
+	daysLeft := bson.D{{Key: "$divide", Value: bson.A{
+		bson.D{{Key: "$subtract", Value: bson.A{"$dueDate", now}}},
+		float64(24 * time.Hour / time.Millisecond),
+	}}}
+	bounded := bson.D{{Key: "$min", Value: bson.A{28, bson.D{{Key: "$max", Value: bson.A{
+		0, bson.D{{Key: "$subtract", Value: bson.A{14, daysLeft}}},
+	}}}}}}
+	due := bson.D{{Key: "$cond", Value: bson.A{
+		bson.D{{Key: "$eq", Value: bson.A{bson.D{{Key: "$type", Value: "$dueDate"}}, "date"}}},
+		bounded,
+		0,
+	}}}
+	return bson.D{{Key: "$add", Value: bson.A{
+		bson.D{{Key: "$multiply", Value: bson.A{10, weight}}},
+		due,
+	}}}
+}
+
+// shiftPriority builds an aggregation expression moving a todo's priority by
+// step levels, capped at the lowest and highest levels. A todo without a
+// priority is treated as low.
+func shiftPriority(step int) bson.D {
+	clamp := func(i int) string {
+		if i < 0 {
+			i = 0
+		}
+		if i >= len(priorities) {
+			i = len(priorities) - 1
+		}
+		return priorities[i]
+	}
+
+	branches := bson.A{}
+	for i, level := range priorities {
+		branches = append(branches, bson.D{
+			{Key: "case", Value: bson.D{{Key: "$eq", Value: bson.A{"$priority", level}}}},
+			{Key: "then", Value: clamp(i + step)},
+		})
+	}
+	return bson.D{{Key: "$switch", Value: bson.D{
+		{Key: "branches", Value: branches},
+		{Key: "default", Value: clamp(step)},
+	}}}
+}
+
+// limitText enforces the maximum text length, either rejecting the todo with
+// a 422 or truncating its text and flagging it with X-Truncated-Field.
+func limitText(c *fiber.Ctx, todo *Todo) error {
+	if config.MaxTextLength <= 0 || int64(utf8.RuneCountInString(todo.Text)) <= config.MaxTextLength {
+		return nil
+	}
+	if config.TextOverflow != "truncate" {
+		return fiber.NewError(422, fmt.Sprintf("text must be at most %d characters", config.MaxTextLength))
+	}
+	todo.Text = string([]rune(todo.Text)[:config.MaxTextLength])
+	c.Set("X-Truncated-Field", "text")
+	return nil
+}
+
+// validCoordinates reports whether the given longitude and latitude are in range.
+func validCoordinates(lng, lat float64) bool {
+	return lng >= -180 && lng <= 180 && lat >= -90 && lat <= 90
+}
+
+// validateTodo checks the client-supplied fields of a todo.
+func validateTodo(todo *Todo) error {
+	if todo.Priority != "" && !validPriority(todo.Priority) {
+		return fiber.NewError(422, "priority must be one of "+strings.Join(priorities, ", "))
+	}
+	if todo.Status != "" && !validStatus(todo.Status) {
+		return fiber.NewError(422, "status must be one of "+strings.Join(statuses, ", "))
+	}
+	if tag := duplicateTag(todo.Tags); config.StrictTags && tag != "" {
+		return fiber.NewError(422, fmt.Sprintf("tags contains %q more than once", tag))
+	}
+	if location := todo.Location; location != nil {
+		if location.Type != "Point" || len(location.Coordinates) != 2 ||
+			!validCoordinates(location.Coordinates[0], location.Coordinates[1]) {
+			return fiber.NewError(422, "location must be a GeoJSON Point with [longitude, latitude] coordinates")
+		}
+	}
+	return nil
+}
+
+// listFilters are the whitelisted filters of the list endpoint
+var listFilters = []string{"completed", "status", "priority", "tag", "hasDueDate", "untagged", "source", "blocked"}
+
+// filterParams returns the list filter query parameters followed by the given ones.
+func filterParams(params ...string) []string {
+	return append(append([]string{}, listFilters...), params...)
+}
+
+// buildFilter builds the query matching the list filters of the request.
+func buildFilter(c *fiber.Ctx) (bson.D, error) {
+	return buildFilterFrom(func(key string) string {
+		return c.Query(key)
+	})
+}
+
+// buildFilterFrom builds the query matching the whitelisted list filters:
+// completed, status, priority, tag, hasDueDate, untagged, source and blocked. get returns the raw value of a
+// filter, or "" when it is not set. Filters are combined with AND.
+func buildFilterFrom(get func(key string) string) (bson.D, error) {
+	filter := bson.D{}
+
+	if raw := get("completed"); raw != "" {
+		completed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fiber.NewError(400, "completed must be true or false")
+		}
+		filter = append(filter, bson.E{Key: "completed", Value: completed})
+	}
+	if status := get("status"); status != "" {
+		if !validStatus(status) {
+			return nil, fiber.NewError(400, "status must be one of "+strings.Join(statuses, ", "))
+		}
+		filter = append(filter, bson.E{Key: "status", Value: status})
+	}
+	if priority := get("priority"); priority != "" {
+		if !validPriority(priority) {
+			return nil, fiber.NewError(400, "priority must be one of "+strings.Join(priorities, ", "))
+		}
+		filter = append(filter, bson.E{Key: "priority", Value: priority})
+	}
+	if tag := get("tag"); tag != "" {
+		filter = append(filter, bson.E{Key: "tags", Value: tag})
+	}
+	if raw := get("hasDueDate"); raw != "" {
+		hasDueDate, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fiber.NewError(400, "hasDueDate must be true or false")
+		}
+		filter = append(filter, bson.E{Key: "dueDate", Value: bson.D{{Key: "$exists", Value: hasDueDate}}})
+	}
+	if raw := get("untagged"); raw != "" {
+		untagged, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fiber.NewError(400, "untagged must be true or false")
+		}
+		if untagged {
+			// null also matches todos without a tags field
+			filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+				bson.D{{Key: "tags", Value: bson.D{{Key: "$size", Value: 0}}}},
+				bson.D{{Key: "tags", Value: nil}},
+			}})
+		} else {
+			filter = append(filter, bson.E{Key: "tags.0", Value: bson.D{{Key: "$exists", Value: true}}})
+		}
+	}
+	if source := get("source"); source != "" {
+		filter = append(filter, bson.E{Key: "source", Value: source})
+	}
+	if raw := get("blocked"); raw != "" {
+		blocked, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fiber.NewError(400, "blocked must be true or false")
+		}
+		// todos created before blocking existed have no blocked field
+		if blocked {
+			filter = append(filter, bson.E{Key: "blocked", Value: true})
+		} else {
+			filter = append(filter, bson.E{Key: "blocked", Value: bson.D{{Key: "$ne", Value: true}}})
+		}
+	}
+
+	return filter, nil
+}
+
+// stampCreated sets the field timestamps of a new todo, every tracked field
+// counts as modified when the todo is created. It does nothing unless
+// FIELD_TIMESTAMPS is on.
+func stampCreated(todo *Todo, now time.Time) {
+	todo.FieldUpdatedAt = nil
+	if !config.FieldTimestamps {
+		return
+	}
+	todo.FieldUpdatedAt = make(map[string]time.Time, len(trackedFields))
+	for _, field := range trackedFields {
+		todo.FieldUpdatedAt[field] = now
+	}
+}
+
+// changedFields returns the tracked fields that differ between two versions of a todo.
+func changedFields(before, after *Todo) []string {
+	var changed []string
+	if before.Text != after.Text {
+		changed = append(changed, "text")
+	}
+	if before.Completed != after.Completed {
+		changed = append(changed, "completed")
+	}
+	if before.Status != after.Status {
+		changed = append(changed, "status")
+	}
+	if strings.Join(before.Tags, "\x00") != strings.Join(after.Tags, "\x00") {
+		changed = append(changed, "tags")
+	}
+	if before.Priority != after.Priority {
+		changed = append(changed, "priority")
+	}
+	if (before.DueDate == nil) != (after.DueDate == nil) ||
+		(before.DueDate != nil && !before.DueDate.Equal(*after.DueDate)) {
+		changed = append(changed, "dueDate")
+	}
+	return changed
+}
+
+// icsTimeFormat is the UTC date-time format used by iCalendar
+const icsTimeFormat = "20060102T150405Z"
+
+// icsEscaper escapes TEXT values as described in RFC 5545 section 3.3.11
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// writeICSLine writes a content line, folding it at 75 octets as required by
+// RFC 5545 without splitting multi-byte characters.
+func writeICSLine(b *strings.Builder, line string) {
+	// continuation lines start with a space, leaving room for 74 octets
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		limit = 74
+	}
+	b.WriteString(line + "\r\n")
+}
+
+// normalizeText trims, lowercases and collapses the whitespace of a todo text
+// so that "Buy  milk" and "buy milk" are considered the same todo.
+func normalizeText(text string) string {
+	return strings.ToLower(strings.Join(strings.Fields(text), " "))
+}
+
+// Connect configures the MongoDB client and initializes the database connection.
+// Source: https://www.mongodb.com/blog/post/quick-start-golang--mongodb--starting-and-setup
+func Connect() error {
+	client, err := mongo.NewClient(options.Client().ApplyURI(config.MongoURI))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err = client.Connect(ctx)
+	db := client.Database(dbName)
+
+	if err != nil {
+		return err
+	}
+
+	mg = MongoInstance{
+		Client: client,
+		Db:     db,
+	}
+
+	return nil
+}
+
+// MigrateStatus gives a status to the todos created before statuses existed:
+// completed todos are done, the others are still to do. Todos that already
+// have a status are left untouched, so running it again is a no-op.
+func MigrateStatus() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	collection := mg.Db.Collection("todos")
+	for _, completed := range []bool{true, false} {
+		status := StatusTodo
+		if completed {
+			status = StatusDone
+		}
+		filter := bson.D{
+			{Key: "status", Value: bson.D{{Key: "$exists", Value: false}}},
+			{Key: "completed", Value: completed},
+		}
+		update := bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: status}}}}
+		result, err := collection.UpdateMany(ctx, filter, update)
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount > 0 {
+			log.Printf("Migrated %d todos to the %s status", result.ModifiedCount, status)
+		}
+	}
+	return nil
+}
+
+// EnsureIndexes creates the indexes required by the enabled features.
+// Creating an index that already exists is a no-op in MongoDB.
+func EnsureIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// the default indexes serve the common queries, operators may tune them
+	indexes := defaultIndexes()
+	if customIndexes != nil {
+		indexes = append([]mongo.IndexModel(nil), customIndexes...)
+	}
+
+	// the features relying on an index get it regardless
+	indexes = append(indexes, mongo.IndexModel{
+		// serves the geospatial queries
+		Keys: bson.D{{Key: "location", Value: "2dsphere"}},
+	})
+	if config.NormalizeText {
+		// sparse so that todos created before normalization was enabled don't collide
+		indexes = append(indexes, mongo.IndexModel{
+			Keys:    bson.D{{Key: "normalizedText", Value: 1}},
+			Options: options.Index().SetUnique(true).SetSparse(true),
+		})
+	}
+
+	names, err := mg.Db.Collection("todos").Indexes().CreateMany(ctx, indexes)
+	if err != nil {
+		return err
+	}
+	log.Printf("Ensured indexes: %s", strings.Join(names, ", "))
+	return nil
+}
+
+// defaultIndexes are the indexes created when INDEX_SPEC_FILE is not set.
+func defaultIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		// serves the recently completed todos
+		{
+			Keys:    bson.D{{Key: "completedAt", Value: -1}},
+			Options: options.Index().SetSparse(true),
+		},
+		// serves the tag lookups
+		{
+			Keys: bson.D{{Key: "tags", Value: 1}},
+		},
+		// serves the due date lookups
+		{
+			Keys:    bson.D{{Key: "dueDate", Value: 1}},
+			Options: options.Index().SetSparse(true),
+		},
+		// serves the child lookups of the todo tree
+		{
+			Keys:    bson.D{{Key: "parentId", Value: 1}},
+			Options: options.Index().SetSparse(true),
+		},
+		// most queries target the active list, so only incomplete todos are indexed
+		{
+			Keys: bson.D{{Key: "completed", Value: 1}},
+			Options: options.Index().
+				SetName("active_todos").
+				SetPartialFilterExpression(bson.D{{Key: "completed", Value: false}}),
+		},
+		// serves the incomplete todos sorted by due date, such as GET /overdue
+		{
+			Keys: bson.D{{Key: "completed", Value: 1}, {Key: "dueDate", Value: 1}},
+		},
+	}
+}
+
+// runPurgeJob periodically deletes the completed todos that are older than
+// the configured retention period. It never returns.
+func runPurgeJob() {
+	ticker := time.NewTicker(config.PurgeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		purgeCompleted()
+	}
+}
+
+// purgeCompleted deletes the todos completed before the retention period.
+// Docs: https://docs.mongodb.com/manual/reference/method/db.collection.deleteMany/
+func purgeCompleted() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// locked todos are kept until they are unlocked
+	filter := bson.D{
+		{Key: "completed", Value: true},
+		{Key: "completedAt", Value: bson.D{{Key: "$lt", Value: time.Now().UTC().Add(-config.Retention)}}},
+		notLocked,
+	}
+	collection := mg.Db.Collection("todos")
+	candidates, err := findTodos(ctx, filter, options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		log.Println("purge:", err)
+		return
+	}
+
+	// the todos are deleted one at a time so that their children are handled
+	// like on DELETE /:id, against the parent they have at that point
+	var purged int
+	for _, candidate := range candidates {
+		id, err := primitive.ObjectIDFromHex(candidate.ID)
+		if err != nil {
+			continue
+		}
+		if locked, err := lockedDescendants(ctx, id); err != nil || locked {
+			continue
+		}
+		deleted := &Todo{}
+		query := append(bson.D{{Key: "_id", Value: id}}, filter...)
+		if err := collection.FindOneAndDelete(ctx, query).Decode(deleted); err != nil {
+			if err != mongo.ErrNoDocuments {
+				log.Println("purge:", err)
+			}
+			continue
+		}
+		if err := removeChildren(ctx, deleted); err != nil {
+			log.Println("purge:", err)
+		}
+		purged++
+	}
+	if purged > 0 {
+		statsCache.clear()
+	}
+	log.Printf("Purged %d todos completed more than %s ago", purged, config.Retention)
+}
+
+// notLocked is the filter element guarding writes against locked todos
+var notLocked = bson.E{Key: "locked", Value: bson.D{{Key: "$ne", Value: true}}}
+
+// explainUnmatched responds to a write on a single todo that matched nothing:
+// with a 404 when the todo does not exist, a 423 when it is locked, and with
+// the given status otherwise.
+func explainUnmatched(c *fiber.Ctx, todoID primitive.ObjectID, status int) error {
+	todo := &Todo{}
+	err := mg.Db.Collection("todos").FindOne(c.Context(), bson.D{{Key: "_id", Value: todoID}}).Decode(todo)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.SendStatus(404)
+		}
+		return c.SendStatus(500)
+	}
+	if todo.Locked {
+		return c.Status(423).SendString("The todo is locked")
+	}
+	return c.SendStatus(status)
+}
+
+// retryLater responds with a throttling or unavailability status along with a
+// Retry-After header, so that every such response gives clients backoff guidance.
+func retryLater(c *fiber.Ctx, status int, message string) error {
+	seconds := int64(math.Ceil(config.RetryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Set(fiber.HeaderRetryAfter, strconv.FormatInt(seconds, 10))
+	return c.Status(status).SendString(message)
+}
+
+// timedOut reports whether a database error was caused by a deadline.
+func timedOut(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || mongo.IsTimeout(err)
+}
+
+// validateParent checks that parentID can become the parent of the todo
+// todoID, which is nil for a todo being created: the parent must exist and
+// must not be nested under the todo itself, which would create a cycle.
+func validateParent(ctx context.Context, todoID *primitive.ObjectID, parentID primitive.ObjectID) error {
+	collection := mg.Db.Collection("todos")
+
+	current := parentID
+	for depth := 0; ; depth++ {
+		if todoID != nil && current == *todoID {
+			return fiber.NewError(422, "A todo can't be nested under itself")
+		}
+		if depth >= maxTreeDepth {
+			return fiber.NewError(422, fmt.Sprintf("Todos can't be nested more than %d levels deep", maxTreeDepth))
+		}
+
+		ancestor := &Todo{}
+		err := collection.FindOne(ctx, bson.D{{Key: "_id", Value: current}}).Decode(ancestor)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				if current == parentID {
+					return fiber.NewError(422, "The parent todo does not exist")
+				}
+				// a dangling reference higher up ends the chain
+				return nil
+			}
+			return err
+		}
+		if ancestor.ParentID == nil {
+			return nil
+		}
+		current = *ancestor.ParentID
+	}
+}
+
+// buildTree nests the todos under their parents. Todos whose parent is
+// missing become roots, and so does one todo of any cycle found in the data.
+func buildTree(todos []Todo) []*TreeNode {
+	nodes := make(map[string]*TreeNode, len(todos))
+	for _, todo := range todos {
+		nodes[todo.ID] = &TreeNode{Todo: todo, Children: make([]*TreeNode, 0)}
+	}
+
+	roots := make([]*TreeNode, 0)
+	for _, todo := range todos {
+		node := nodes[todo.ID]
+		if todo.ParentID == nil {
+			roots = append(roots, node)
+			continue
+		}
+		if parent, ok := nodes[todo.ParentID.Hex()]; ok {
+			parent.Children = append(parent.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+
+	// todos in a cycle are unreachable from the roots; detach one of each
+	// cycle from its parent so that the result is always a forest
+	reached := make(map[string]bool, len(todos))
+	var walk func(node *TreeNode)
+	walk = func(node *TreeNode) {
+		reached[node.ID] = true
+		for _, child := range node.Children {
+			walk(child)
+		}
+	}
+	for _, root := range roots {
+		walk(root)
+	}
+	for _, todo := range todos {
+		if reached[todo.ID] {
+			continue
+		}
+		node := nodes[todo.ID]
+		parent := nodes[todo.ParentID.Hex()]
+		for i, child := range parent.Children {
+			if child == node {
+				parent.Children = append(parent.Children[:i], parent.Children[i+1:]...)
+				break
+			}
+		}
+		roots = append(roots, node)
+		walk(node)
+	}
+
+	return roots
+}
+
+// removeChildren deletes or reparents the children of a deleted todo,
+// depending on CASCADE_DELETE.
+func removeChildren(ctx context.Context, deleted *Todo) error {
+	collection := mg.Db.Collection("todos")
+	deletedID, err := primitive.ObjectIDFromHex(deleted.ID)
+	if err != nil {
+		return err
+	}
+
+	if !config.CascadeDelete {
+		// move the children up to the deleted todo's own parent, bumping
+		// updatedAt so that sync clients see the new parent
+		now := time.Now().UTC()
+		update := bson.D{
+			{Key: "$set", Value: bson.D{{Key: "updatedAt", Value: now}}},
+			{Key: "$unset", Value: bson.D{{Key: "parentId", Value: ""}}},
+		}
+		if deleted.ParentID != nil {
+			update = bson.D{{Key: "$set", Value: bson.D{
+				{Key: "parentId", Value: *deleted.ParentID},
+				{Key: "updatedAt", Value: now},
+			}}}
+		}
+		_, err := collection.UpdateMany(ctx, bson.D{{Key: "parentId", Value: deletedID}}, update)
+		return err
+	}
+
+	descendants, err := descendantsOf(ctx, deletedID)
+	if err != nil || len(descendants) == 0 {
+		return err
+	}
+	// callers refuse to delete todos with locked descendants, see
+	// lockedDescendants, this only guards against a lock taken in between
+	_, err = collection.DeleteMany(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: descendants}}}, notLocked})
+	return err
+}
+
+// descendantsOf returns the IDs of the todos nested under the given one.
+func descendantsOf(ctx context.Context, id primitive.ObjectID) ([]primitive.ObjectID, error) {
+	// collect the descendants level by level, the depth bound guards against cycles
+	descendants := []primitive.ObjectID{}
+	frontier := []primitive.ObjectID{id}
+	for depth := 0; len(frontier) > 0 && depth < maxTreeDepth; depth++ {
+		opts := options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}})
+		children, err := findTodos(ctx, bson.D{{Key: "parentId", Value: bson.D{{Key: "$in", Value: frontier}}}}, opts)
+		if err != nil {
+			return nil, err
+		}
+		frontier = frontier[:0]
+		for _, child := range children {
+			childID, err := primitive.ObjectIDFromHex(child.ID)
+			if err != nil {
+				return nil, err
+			}
+			frontier = append(frontier, childID)
+		}
+		descendants = append(descendants, frontier...)
+	}
+	return descendants, nil
+}
+
+// lockedDescendants reports whether deleting the given todo would cascade to
+// locked todos. It is always false without CASCADE_DELETE, since the children
+// are then moved up rather than deleted.
+func lockedDescendants(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	if !config.CascadeDelete {
+		return false, nil
+	}
+	descendants, err := descendantsOf(ctx, id)
+	if err != nil || len(descendants) == 0 {
+		return false, err
+	}
+	filter := bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: descendants}}}, {Key: "locked", Value: true}}
+	count, err := mg.Db.Collection("todos").CountDocuments(ctx, filter)
+	return count > 0, err
+}
+
+// collectionChecksum derives a weak checksum of the todos collection from the
+// number of todos, the latest updatedAt and the latest ID. Any create, update
+// or delete changes at least one of them.
+func collectionChecksum(ctx context.Context) (string, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: nil},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "maxUpdatedAt", Value: bson.D{{Key: "$max", Value: "$updatedAt"}}},
+			{Key: "maxId", Value: bson.D{{Key: "$max", Value: "$_id"}}},
+		}}},
+	}
+	cursor, err := mg.Db.Collection("todos").Aggregate(ctx, pipeline)
+	if err != nil {
+		return "", err
+	}
+
+	var state []struct {
+		Count        int64              `bson:"count"`
+		MaxUpdatedAt time.Time          `bson:"maxUpdatedAt"`
+		MaxID        primitive.ObjectID `bson:"maxId"`
+	}
+	if err := cursor.All(ctx, &state); err != nil {
+		return "", err
+	}
+
+	summary := "0"
+	if len(state) > 0 {
+		summary = fmt.Sprintf("%d|%d|%s", state[0].Count, state[0].MaxUpdatedAt.UnixMilli(), state[0].MaxID.Hex())
+	}
+	sum := sha256.Sum256([]byte(summary))
+	return hex.EncodeToString(sum[:16]), nil
+}
+
+// shapeTodos returns the todos as is, or keyed by their ID for the map shape.
+func shapeTodos(todos []Todo, shape string) interface{} {
+	if shape != "map" {
+		return todos
+	}
+	byID := make(map[string]Todo, len(todos))
+	for _, todo := range todos {
+		byID[todo.ID] = todo
+	}
+	return byID
+}
+
+// findTodos returns all the todos matching the filter.
+func findTodos(ctx context.Context, filter interface{}, opts ...*options.FindOptions) ([]Todo, error) {
+	cursor, err := mg.Db.Collection("todos").Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	todos := make([]Todo, 0)
+	if err := cursor.All(ctx, &todos); err != nil {
+		return nil, err
+	}
+	return todos, nil
+}
+
+// textDuplicate reports whether a duplicate key error was raised by the
+// unique normalized text index rather than by a custom unique index.
+func textDuplicate(err error) bool {
+	return mongo.IsDuplicateKeyError(err) && strings.Contains(err.Error(), "normalizedText")
+}
+
+// duplicateKey responds to a write rejected by a unique index, with the
+// conflicting todo for the normalized text index and with a plain 409 for the
+// custom unique indexes of INDEX_SPEC_FILE.
+func duplicateKey(c *fiber.Ctx, err error, normalizedText string) error {
+	if normalizedText != "" && textDuplicate(err) {
+		return textConflict(c, normalizedText)
+	}
+	return c.Status(409).SendString("The todo conflicts with an existing one on a unique index")
+}
+
+// textConflict responds to a write rejected by the unique normalized text
+// index with a 409 holding the todo already using that text, so that clients
+// can update it instead.
+func textConflict(c *fiber.Ctx, normalizedText string) error {
+	existing := &Todo{}
+	err := mg.Db.Collection("todos").FindOne(c.Context(), bson.D{{Key: "normalizedText", Value: normalizedText}}).Decode(existing)
+	if err != nil {
+		// the conflicting todo may have been deleted in the meantime
+		return c.Status(409).SendString("A todo with the same text already exists")
+	}
+	return c.Status(409).JSON(fiber.Map{
+		"error":    "A todo with the same text already exists",
+		"existing": existing,
+	})
+}
+
+// insertTodo stores a new todo and responds with the created record.
+// Docs: https://docs.mongodb.com/manual/reference/command/insert/
+func insertTodo(c *fiber.Ctx, todo *Todo) error {
+	collection := mg.Db.Collection("todos")
+
+	// insert the record
+	insertionResult, err := collection.InsertOne(c.Context(), todo)
+	if err != nil {
+		// a todo with the same normalized text, or unique key, already exists
+		if mongo.IsDuplicateKeyError(err) {
+			return duplicateKey(c, err, todo.NormalizedText)
+		}
+		return c.Status(500).SendString(err.Error())
+	}
+
+	// get the just inserted record in order to return it as response
+	filter := bson.D{{Key: "_id", Value: insertionResult.InsertedID}}
+	createdRecord := collection.FindOne(c.Context(), filter)
+
+	// decode the Mongo record into Todo
+	createdTodo := &Todo{}
+	createdRecord.Decode(createdTodo)
+
+	// return the created Todo in JSON format
+	return c.Status(201).JSON(createdTodo)
+}
+
+// streamFlushEvery is the number of streamed todos written between flushes
+const streamFlushEvery = 100
+
+// streamTodos writes the todos of a cursor to the response incrementally, so
+// that memory stays bounded no matter how many records are sent. write is
+// called for every todo, between the given prefix and suffix. Errors after the
+// response has started can only be logged.
+func streamTodos(c *fiber.Ctx, cursor *mongo.Cursor, prefix, suffix string, write func(w *bufio.Writer, index int, todo *Todo) error) {
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		ctx := context.Background()
+		defer cursor.Close(ctx)
+
+		w.WriteString(prefix)
+		for count := 0; cursor.Next(ctx); count++ {
+			todo := &Todo{}
+			if err := cursor.Decode(todo); err != nil {
+				log.Println("stream:", err)
+				break
+			}
+			if err := write(w, count, todo); err != nil {
+				log.Println("stream:", err)
+				break
+			}
+			if (count+1)%streamFlushEvery == 0 {
+				if err := w.Flush(); err != nil {
+					// the client went away
+					return
+				}
+			}
+		}
+		if err := cursor.Err(); err != nil {
+			log.Println("stream:", err)
+		}
+		w.WriteString(suffix)
+		w.Flush()
+	})
+}
+
+// streamJSONArray streams the todos of a cursor as a JSON array.
+func streamJSONArray(c *fiber.Ctx, cursor *mongo.Cursor) error {
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	streamTodos(c, cursor, "[", "]", func(w *bufio.Writer, index int, todo *Todo) error {
+		data, err := json.Marshal(todo)
+		if err != nil {
+			return err
+		}
+		if index > 0 {
+			w.WriteString(",")
+		}
+		_, err = w.Write(data)
+		return err
+	})
+	return nil
+}
+
+// streamNDJSON streams the todos of a cursor as newline delimited JSON.
+func streamNDJSON(c *fiber.Ctx, cursor *mongo.Cursor) error {
+	c.Set(fiber.HeaderContentType, "application/x-ndjson")
+	streamTodos(c, cursor, "", "", func(w *bufio.Writer, _ int, todo *Todo) error {
+		data, err := json.Marshal(todo)
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return w.WriteByte('\n')
+	})
+	return nil
+}
+
+// csvHeader lists the columns of the CSV export
+var csvHeader = []string{"id", "text", "completed", "priority", "tags", "dueDate", "completedAt", "createdAt", "updatedAt"}
+
+// streamCSV streams the todos of a cursor as CSV, tags are separated by ";".
+func streamCSV(c *fiber.Ctx, cursor *mongo.Cursor) error {
+	c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+
+	header := strings.Join(csvHeader, ",") + "\n"
+	streamTodos(c, cursor, header, "", func(w *bufio.Writer, _ int, todo *Todo) error {
+		out := csv.NewWriter(w)
+		out.Write([]string{
+			todo.ID,
+			todo.Text,
+			strconv.FormatBool(todo.Completed),
+			todo.Priority,
+			strings.Join(todo.Tags, ";"),
+			formatTime(todo.DueDate),
+			formatTime(todo.CompletedAt),
+			formatTime(todo.CreatedAt),
+			formatTime(todo.UpdatedAt),
+		})
+		// hand the row over to the response writer
+		out.Flush()
+		return out.Error()
+	})
+	return nil
+}
+
+// insertTodoIfNotExists creates the todo unless one with the same normalized
+// text already exists, in which case the existing todo is returned with a 200.
+// It requires NORMALIZE_TEXT, whose unique index makes concurrent upserts safe
+// and keeps the normalized text of every todo up to date.
+// Docs: https://docs.mongodb.com/manual/reference/method/db.collection.updateOne/#upsert-option
+func insertTodoIfNotExists(c *fiber.Ctx, todo *Todo) error {
+	collection := mg.Db.Collection("todos")
+
+	filter := bson.D{{Key: "normalizedText", Value: todo.NormalizedText}}
+	update := bson.D{{Key: "$setOnInsert", Value: todo}}
+	opts := options.Update().SetUpsert(true)
+
+	result, err := collection.UpdateOne(c.Context(), filter, update, opts)
+	// a concurrent upsert may have won the race on the unique index
+	if err != nil && !textDuplicate(err) {
+		if mongo.IsDuplicateKeyError(err) {
+			return duplicateKey(c, err, todo.NormalizedText)
+		}
+		return c.Status(500).SendString(err.Error())
+	}
+
+	status := 200
+	if err == nil && result.UpsertedID != nil {
+		status = 201
+		filter = bson.D{{Key: "_id", Value: result.UpsertedID}}
+	}
+
+	record := &Todo{}
+	if err := collection.FindOne(c.Context(), filter).Decode(record); err != nil {
+		return c.Status(500).SendString(err.Error())
+	}
+	return c.Status(status).JSON(record)
+}
+
+func main() {
+	LoadConfig()
+
+	// Connect to the database
+	if err := Connect(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := EnsureIndexes(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := MigrateStatus(); err != nil {
+		log.Fatal(err)
+	}
+
+	// the retention job only runs when a retention period is configured
+	if config.Retention > 0 && config.PurgeInterval > 0 {
+		go runPurgeJob()
+	}
+
+	// Create a Fiber app
+	app := fiber.New()
+
+	app.Use(invalidateOnWrite)
+	app.Use(formatTimes)
+	app.Use(limitDB)
+	app.Use("/stats", statsETag, cacheStats)
+
+	// Administrative endpoints, only available when ADMIN_ENABLED is set
+	admin := app.Group("/admin", requireAdmin)
+
+	// Get the effective configuration of this instance, without secrets
+	admin.Get("/config", allowQuery(), func(c *fiber.Ctx) error {
+		return c.JSON(effectiveConfig())
+	})
+
+	// Give the todos created before createdAt existed the creation time
+	// embedded in their ObjectID
+	// Docs: https://docs.mongodb.com/manual/reference/method/db.collection.bulkWrite/
+	admin.Post("/backfill-timestamps", allowQuery(), func(c *fiber.Ctx) error {
+		collection := mg.Db.Collection("todos")
+		missing := bson.D{{Key: "createdAt", Value: bson.D{{Key: "$exists", Value: false}}}}
+		cursor, err := collection.Find(c.Context(), missing, options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}}))
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		defer cursor.Close(context.Background())
+
+		// the updates are sent in batches to bound memory on large collections,
+		// and bump updatedAt so that checksums and sync clients see the change
+		const batchSize = 500
+		now := time.Now().UTC()
+		var backfilled int64
+		models := make([]mongo.WriteModel, 0, batchSize)
+		flush := func() error {
+			if len(models) == 0 {
+				return nil
+			}
+			result, err := collection.BulkWrite(c.Context(), models, options.BulkWrite().SetOrdered(false))
+			if err != nil {
+				return err
+			}
+			backfilled += result.ModifiedCount
+			models = models[:0]
+			return nil
+		}
+
+		for cursor.Next(c.Context()) {
+			var doc struct {
+				ID primitive.ObjectID `bson:"_id"`
+			}
+			// only ObjectIDs carry a creation time
+			if err := cursor.Decode(&doc); err != nil {
+				continue
+			}
+			// the filter keeps a createdAt set in the meantime
+			filter := bson.D{{Key: "_id", Value: doc.ID}, missing[0]}
+			update := bson.D{{Key: "$set", Value: bson.D{
+				{Key: "createdAt", Value: doc.ID.Timestamp().UTC()},
+				{Key: "updatedAt", Value: now},
+			}}}
+			models = append(models, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update))
+			if len(models) == batchSize {
+				if err := flush(); err != nil {
+					return c.Status(500).SendString(err.Error())
+				}
+			}
+		}
+		if err := cursor.Err(); err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		if err := flush(); err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+
+		log.Printf("Backfilled the creation time of %d todos", backfilled)
+		return c.JSON(fiber.Map{"backfilled": backfilled})
+	})
+
+	// Get all todos records from MongoDB
+	// Docs: https://docs.mongodb.com/manual/reference/command/find/
+	app.Get("/", allowQuery(filterParams("limit", "offset", "stream", "completedLast", "shape")...), func(c *fiber.Ctx) error {
+		// the todos are listed as an array unless keyed by ID
+		shape := c.Query("shape", "array")
+		if shape != "array" && shape != "map" {
+			return fiber.NewError(400, "shape must be array or map")
+		}
+
+		// streamed lists are not paginated unless the client asks for a limit
+		stream := c.Query("stream") == "true"
+		if stream && shape == "map" {
+			return fiber.NewError(400, "streamed lists can only be arrays")
+		}
+		defaultLimit, maxLimit := config.DefaultPageSize, config.MaxPageSize
+		if stream {
+			defaultLimit, maxLimit = 0, math.MaxInt64
+		}
+
+		limit, err := queryLimit(c, defaultLimit, maxLimit)
+		if err != nil {
+			return err
+		}
+		offset, err := queryOffset(c)
+		if err != nil {
+			return err
+		}
+
+		query, err := buildFilter(c)
+		if err != nil {
+			return err
+		}
+		if config.HideBlocked && c.Query("blocked") == "" {
+			query = append(query, bson.E{Key: "blocked", Value: bson.D{{Key: "$ne", Value: true}}})
+		}
+
+		// incomplete todos can be listed before completed ones regardless of the order
+		completedLast := config.CompletedLast
+		if raw := c.Query("completedLast"); raw != "" {
+			completedLast, err = strconv.ParseBool(raw)
+			if err != nil {
+				return fiber.NewError(400, "completedLast must be true or false")
+			}
+		}
+		order := bson.D{{Key: "_id", Value: 1}}
+		if completedLast {
+			order = append(bson.D{{Key: "completed", Value: 1}}, order...)
+		}
+
+		// get one page of records as a cursor, in a stable order
+		opts := options.Find().
+			SetSort(order).
+			SetSkip(offset).
+			SetLimit(limit)
+
+		if stream {
+			// the stream outlives the handler, so it can't use the request context
+			cursor, err := mg.Db.Collection("todos").Find(context.Background(), query, opts)
+			if err != nil {
+				return c.Status(500).SendString(err.Error())
+			}
+			return streamJSONArray(c, cursor)
+		}
+
+		var ctx context.Context = c.Context()
+		if config.QueryTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, config.QueryTimeout)
+			defer cancel()
+		}
+
+		cursor, err := mg.Db.Collection("todos").Find(ctx, query, opts)
+		if err != nil {
+			if timedOut(err) {
+				return retryLater(c, 504, "The database took too long to respond")
+			}
+			return c.Status(500).SendString(err.Error())
+		}
+		defer cursor.Close(context.Background())
+
+		var todos []Todo = make([]Todo, 0)
+
+		// iterate the cursor and decode each item into an Employee
+		for cursor.Next(ctx) {
+			todo := Todo{}
+			if err := cursor.Decode(&todo); err != nil {
+				return c.Status(500).SendString(err.Error())
+			}
+			todos = append(todos, todo)
+		}
+		if err := cursor.Err(); err != nil {
+			if !timedOut(err) {
+				return c.Status(500).SendString(err.Error())
+			}
+			// trade completeness for responsiveness when allowed to
+			if !config.PartialResults {
+				return retryLater(c, 504, "The database took too long to respond")
+			}
+			c.Set("X-Partial", "true")
+			return c.Status(206).JSON(shapeTodos(todos, shape))
+		}
+		// return employees list in JSON format
+		return c.JSON(shapeTodos(todos, shape))
+	})
+
+	// Insert a new employee into MongoDB
+	// Docs: https://docs.mongodb.com/manual/reference/command/insert/
+	app.Post("/", allowQuery("ifNotExists"), trimBody, func(c *fiber.Ctx) error {
+		// without normalization there is no text to match reliably
+		ifNotExists := c.Query("ifNotExists") == "true"
+		if ifNotExists && !config.NormalizeText {
+			return c.Status(400).SendString("ifNotExists requires NORMALIZE_TEXT")
+		}
+
+		// New Todo struct, the omitted fields keep their defaults
+		todo := newTodo()
+		// Parse body into struct
+		if err := c.BodyParser(todo); err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		if err := validateTodo(todo); err != nil {
+			return err
+		}
+		if err := limitText(c, todo); err != nil {
+			return err
+		}
+
+		// force MongoDB to always set its own generated ObjectIDs
+		todo.ID = ""
+
+		// todos are locked through POST /:id/lock and blocked through
+		// POST /:id/block only
+		todo.Locked = false
+		todo.Blocked = false
+		todo.BlockedReason = ""
+
+		// clients may tell where the todo comes from, such as "web"
+		todo.Source = strings.TrimSpace(todo.Source)
+		if todo.Source == "" {
+			todo.Source = SourceAPI
+		}
+
+		if todo.ParentID != nil {
+			if err := validateParent(c.Context(), nil, *todo.ParentID); err != nil {
+				return err
+			}
+		}
+
+		// the normalized text and the timestamps are server-managed
+		now := time.Now().UTC()
+		todo.NormalizedText = ""
+		if config.NormalizeText {
+			todo.NormalizedText = normalizeText(todo.Text)
+		}
+		syncStatus(todo, nil)
+		todo.CompletedAt = nil
+		if todo.Completed {
+			todo.CompletedAt = &now
+		}
+		todo.CreatedAt = &now
+		todo.UpdatedAt = &now
+		// the auto tags only ever add to the client's tags
+		todo.Tags = sanitizeTags(append(todo.Tags, autoTags(todo.Text)...))
+		stampCreated(todo, now)
+
+		if ifNotExists {
+			return insertTodoIfNotExists(c, todo)
+		}
+		return insertTodo(c, todo)
+	})
+
+	// Import a single todo previously exported with GET /:id/export
+	app.Post("/import-one", allowQuery(), trimBody, func(c *fiber.Ctx) error {
+		export := new(TodoExport)
+		if err := c.BodyParser(export); err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		if export.Version != exportVersion {
+			return c.Status(422).SendString("Unsupported export version")
+		}
+
+		// the todo is recreated under a new ID but keeps its history,
+		// as a standalone todo since its parent may not exist here
+		todo := &export.Todo
+		if err := validateTodo(todo); err != nil {
+			return err
+		}
+		if err := limitText(c, todo); err != nil {
+			return err
+		}
+		todo.ParentID = nil
+		todo.Source = SourceImport
+		// the lock and the block are not carried over, like on POST /
+		todo.Locked = false
+		todo.Blocked = false
+		todo.BlockedReason = ""
+		now := time.Now().UTC()
+		todo.ID = ""
+		todo.NormalizedText = ""
+		if config.NormalizeText {
+			todo.NormalizedText = normalizeText(todo.Text)
+		}
+		syncStatus(todo, nil)
+		if !todo.Completed {
+			todo.CompletedAt = nil
+		} else if todo.CompletedAt == nil {
+			todo.CompletedAt = &now
+		}
+		if todo.CreatedAt == nil {
+			todo.CreatedAt = &now
+		}
+		todo.UpdatedAt = &now
+		todo.Tags = sanitizeTags(todo.Tags)
+		stampCreated(todo, now)
+
+		return insertTodo(c, todo)
+	})
+
+	// Get all templates
+	app.Get("/templates", allowQuery(), func(c *fiber.Ctx) error {
+		cursor, err := mg.Db.Collection("templates").Find(c.Context(), bson.D{})
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+
+		var templates []Template = make([]Template, 0)
+		if err := cursor.All(c.Context(), &templates); err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.JSON(templates)
+	})
+
+	// Create a new template
+	app.Post("/templates", allowQuery(), func(c *fiber.Ctx) error {
+		template := new(Template)
+		if err := c.BodyParser(template); err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		if err := validateTemplate(c, template); err != nil {
+			return err
+		}
+
+		template.ID = ""
+		result, err := mg.Db.Collection("templates").InsertOne(c.Context(), template)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+
+		template.ID = result.InsertedID.(primitive.ObjectID).Hex()
+		return c.Status(201).JSON(template)
+	})
+
+	// Find one template by ID
+	app.Get("/templates/:id", allowQuery(), func(c *fiber.Ctx) error {
+		templateID, err := primitive.ObjectIDFromHex(c.Params("id"))
+		if err != nil {
+			return c.SendStatus(400)
+		}
+
+		template := &Template{}
+		filter := bson.D{{Key: "_id", Value: templateID}}
+		if err := mg.Db.Collection("templates").FindOne(c.Context(), filter).Decode(template); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return c.SendStatus(404)
+			}
+			return c.SendStatus(500)
+		}
+		return c.JSON(template)
+	})
+
+	// Replace a template
+	app.Put("/templates/:id", allowQuery(), func(c *fiber.Ctx) error {
+		idParam := c.Params("id")
+		templateID, err := primitive.ObjectIDFromHex(idParam)
+		if err != nil {
+			return c.SendStatus(400)
+		}
+
+		template := new(Template)
+		if err := c.BodyParser(template); err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		if err := validateTemplate(c, template); err != nil {
+			return err
+		}
+
+		template.ID = ""
+		filter := bson.D{{Key: "_id", Value: templateID}}
+		result, err := mg.Db.Collection("templates").ReplaceOne(c.Context(), filter, template)
+		if err != nil {
+			return c.SendStatus(500)
+		}
+		if result.MatchedCount < 1 {
+			return c.SendStatus(404)
+		}
+
+		template.ID = idParam
+		return c.JSON(template)
+	})
+
+	// Delete a template
+	app.Delete("/templates/:id", allowQuery(), func(c *fiber.Ctx) error {
+		templateID, err := primitive.ObjectIDFromHex(c.Params("id"))
+		if err != nil {
+			return c.SendStatus(400)
+		}
+
+		filter := bson.D{{Key: "_id", Value: templateID}}
+		result, err := mg.Db.Collection("templates").DeleteOne(c.Context(), filter)
+		if err != nil {
+			return c.SendStatus(500)
+		}
+		if result.DeletedCount < 1 {
+			return c.SendStatus(404)
+		}
+		return c.SendStatus(204)
+	})
+
+	// Create the todos described by a template
+	app.Post("/templates/:id/instantiate", allowQuery(), func(c *fiber.Ctx) error {
+		templateID, err := primitive.ObjectIDFromHex(c.Params("id"))
+		if err != nil {
+			return c.SendStatus(400)
+		}
+
+		template := &Template{}
+		filter := bson.D{{Key: "_id", Value: templateID}}
+		if err := mg.Db.Collection("templates").FindOne(c.Context(), filter).Decode(template); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return c.SendStatus(404)
+			}
+			return c.SendStatus(500)
+		}
+
+		// relative due offsets are resolved against the instantiation time
+		now := time.Now().UTC()
+		todos := make([]Todo, 0, len(template.Items))
+		documents := make([]interface{}, 0, len(template.Items))
+		for _, item := range template.Items {
+			todo := Todo{
+				Text:      item.Text,
+				Status:    StatusTodo,
+				Source:    SourceTemplate,
+				Tags:      sanitizeTags(append(item.Tags, autoTags(item.Text)...)),
+				CreatedAt: &now,
+				UpdatedAt: &now,
+			}
+			// templates saved before the limit was lowered may hold longer texts
+			if err := limitText(c, &todo); err != nil {
+				return err
+			}
+			if config.NormalizeText {
+				todo.NormalizedText = normalizeText(todo.Text)
+			}
+			if item.DueIn != "" {
+				offset, err := parseOffset(item.DueIn)
+				if err != nil {
+					return c.Status(422).SendString("Template has an invalid due offset")
+				}
+				dueDate := now.Add(offset)
+				todo.DueDate = &dueDate
+			}
+			stampCreated(&todo, now)
+			todos = append(todos, todo)
+			documents = append(documents, todo)
+		}
+
+		if len(documents) == 0 {
+			return c.Status(201).JSON(todos)
+		}
+
+		result, err := mg.Db.Collection("todos").InsertMany(c.Context(), documents)
+		if err != nil {
+			if mongo.IsDuplicateKeyError(err) {
+				// report the todo the first rejected item collides with
+				var bulkErr mongo.BulkWriteException
+				if errors.As(err, &bulkErr) && len(bulkErr.WriteErrors) > 0 {
+					first := bulkErr.WriteErrors[0]
+					if strings.Contains(first.Message, "normalizedText") {
+						return textConflict(c, todos[first.Index].NormalizedText)
+					}
+				}
+				return duplicateKey(c, err, "")
+			}
+			return c.Status(500).SendString(err.Error())
+		}
+
+		for i, id := range result.InsertedIDs {
+			todos[i].ID = id.(primitive.ObjectID).Hex()
+		}
+		return c.Status(201).JSON(todos)
+	})
+
+	// Find groups of todos that share the same normalized text
+	// Docs: https://docs.mongodb.com/manual/reference/operator/aggregation/group/
+	app.Get("/duplicates", allowQuery(), func(c *fiber.Ctx) error {
+		// todos stored before normalization was enabled fall back to their text
+		// normalized like normalizeText does: the lowercased words joined by
+		// single spaces
+		// Docs: https://docs.mongodb.com/manual/reference/operator/aggregation/regexFindAll/
+		words := bson.D{{Key: "$regexFindAll", Value: bson.D{
+			{Key: "input", Value: bson.D{{Key: "$toLower", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$text", ""}}}}}},
+			{Key: "regex", Value: `\S+`},
+		}}}
+		joined := bson.D{{Key: "$reduce", Value: bson.D{
+			{Key: "input", Value: words},
+			{Key: "initialValue", Value: ""},
+			{Key: "in", Value: bson.D{{Key: "$cond", Value: bson.A{
+				bson.D{{Key: "$eq", Value: bson.A{"$$value", ""}}},
+				"$$this.match",
+				bson.D{{Key: "$concat", Value: bson.A{"$$value", " ", "$$this.match"}}},
+			}}}},
+		}}}
+		key := bson.D{{Key: "$ifNull", Value: bson.A{"$normalizedText", joined}}}
+		pipeline := mongo.Pipeline{
+			{{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: key},
+				{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+				{Key: "todos", Value: bson.D{{Key: "$push", Value: "$$ROOT"}}},
+			}}},
+			{{Key: "$match", Value: bson.D{{Key: "count", Value: bson.D{{Key: "$gt", Value: 1}}}}}},
+			{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+		}
+
+		cursor, err := mg.Db.Collection("todos").Aggregate(c.Context(), pipeline)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+
+		groups := make([]struct {
+			Text  string `json:"text" bson:"_id"`
+			Count int    `json:"count" bson:"count"`
+			Todos []Todo `json:"todos" bson:"todos"`
+		}, 0)
+		if err := cursor.All(c.Context(), &groups); err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.JSON(groups)
+	})
+
+	// Move many todos to the same status, reporting the outcome of each
+	app.Post("/bulk-status", allowQuery(), func(c *fiber.Ctx) error {
+		request := new(BulkStatusRequest)
+		if err := c.BodyParser(request); err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		if !validStatus(request.Status) {
+			return c.Status(422).SendString("status must be one of " + strings.Join(statuses, ", "))
+		}
+		if len(request.IDs) > maxBulkStatus {
+			return c.Status(413).SendString(fmt.Sprintf("At most %d todos can be moved at once", maxBulkStatus))
+		}
+
+		collection := mg.Db.Collection("todos")
+		now := time.Now().UTC()
+		results := make([]BulkStatusResult, 0, len(request.IDs))
+		for _, id := range request.IDs {
+			result := BulkStatusResult{ID: id}
+			todoID, err := primitive.ObjectIDFromHex(id)
+			if err != nil {
+				result.Error = "invalid id"
+				results = append(results, result)
+				continue
+			}
+
+			current := &Todo{}
+			if err := collection.FindOne(c.Context(), bson.D{{Key: "_id", Value: todoID}}).Decode(current); err != nil {
+				if err != mongo.ErrNoDocuments {
+					return c.SendStatus(500)
+				}
+				result.Error = "not found"
+				results = append(results, result)
+				continue
+			}
+			if current.Locked {
+				result.Error = "locked"
+				results = append(results, result)
+				continue
+			}
+			if !canTransition(current.Status, request.Status) {
+				result.Error = fmt.Sprintf("cannot move from %s to %s", current.Status, request.Status)
+				results = append(results, result)
+				continue
+			}
+
+			// the status is matched again in case the todo changed in between
+			query := bson.D{{Key: "_id", Value: todoID}, notLocked, {Key: "status", Value: current.Status}}
+			opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+			updated := &Todo{}
+			err = collection.FindOneAndUpdate(c.Context(), query, statusUpdate(request.Status, now), opts).Decode(updated)
+			if err != nil {
+				if err != mongo.ErrNoDocuments {
+					return c.SendStatus(500)
+				}
+				result.Error = "modified concurrently"
+				results = append(results, result)
+				continue
+			}
+			result.OK = true
+			result.Todo = updated
+			results = append(results, result)
+		}
+		return c.JSON(results)
+	})
+
+	// Merge duplicate todos into a single one
+	// Docs: https://docs.mongodb.com/manual/core/transactions/
+	app.Post("/merge", allowQuery(), func(c *fiber.Ctx) error {
+		request := new(MergeRequest)
+		if err := c.BodyParser(request); err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+
+		keepID, err := primitive.ObjectIDFromHex(request.Keep)
+		if err != nil {
+			return c.Status(400).SendString("keep must be a valid ID")
+		}
+		if len(request.Remove) == 0 {
+			return c.Status(400).SendString("remove must list at least one ID")
+		}
+		removeIDs := make([]primitive.ObjectID, 0, len(request.Remove))
+		seen := map[primitive.ObjectID]bool{}
+		for _, id := range request.Remove {
+			removeID, err := primitive.ObjectIDFromHex(id)
+			if err != nil {
+				return c.Status(400).SendString("remove must only contain valid IDs")
+			}
+			if removeID == keepID {
+				return c.Status(400).SendString("keep can't also be removed")
+			}
+			if !seen[removeID] {
+				seen[removeID] = true
+				removeIDs = append(removeIDs, removeID)
+			}
+		}
+
+		session, err := mg.Client.StartSession()
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		defer session.EndSession(c.Context())
+
+		collection := mg.Db.Collection("todos")
+		merged, err := session.WithTransaction(c.Context(), func(sc mongo.SessionContext) (interface{}, error) {
+			kept := &Todo{}
+			if err := collection.FindOne(sc, bson.D{{Key: "_id", Value: keepID}}).Decode(kept); err != nil {
+				if err == mongo.ErrNoDocuments {
+					return nil, fiber.NewError(404, "The todo to keep does not exist")
+				}
+				return nil, err
+			}
+			if kept.Locked {
+				return nil, fiber.NewError(423, "The todo to keep is locked")
+			}
+
+			removeFilter := bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: removeIDs}}}, notLocked}
+			cursor, err := collection.Find(sc, removeFilter)
+			if err != nil {
+				return nil, err
+			}
+			var removed []Todo
+			if err := cursor.All(sc, &removed); err != nil {
+				return nil, err
+			}
+			if len(removed) != len(removeIDs) {
+				// tell locked todos apart from missing ones
+				locked, err := collection.CountDocuments(sc, bson.D{
+					{Key: "_id", Value: bson.D{{Key: "$in", Value: removeIDs}}},
+					{Key: "locked", Value: true},
+				})
+				if err != nil {
+					return nil, err
+				}
+				if locked > 0 {
+					return nil, fiber.NewError(423, "Some of the todos to remove are locked")
+				}
+				return nil, fiber.NewError(404, "Some of the todos to remove do not exist")
+			}
+
+			// fold the removed todos' tags into the kept one
+			tags := kept.Tags
+			for _, todo := range removed {
+				tags = append(tags, todo.Tags...)
+			}
+			now := time.Now().UTC()
+			fields := bson.D{
+				{Key: "tags", Value: sanitizeTags(tags)},
+				{Key: "updatedAt", Value: now},
+			}
+			if config.FieldTimestamps {
+				fields = append(fields, bson.E{Key: "fieldUpdatedAt.tags", Value: now})
+			}
+			update := bson.D{{Key: "$set", Value: fields}}
+			opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+			updated := &Todo{}
+			if err := collection.FindOneAndUpdate(sc, bson.D{{Key: "_id", Value: keepID}, notLocked}, update, opts).Decode(updated); err != nil {
+				if err == mongo.ErrNoDocuments {
+					return nil, fiber.NewError(423, "The todo to keep is locked")
+				}
+				return nil, err
+			}
+
+			// the removed todos' children are handled like on DELETE /:id
+			for i := range removed {
+				removedID, err := primitive.ObjectIDFromHex(removed[i].ID)
+				if err != nil {
+					return nil, err
+				}
+				if config.CascadeDelete {
+					descendants, err := descendantsOf(sc, removedID)
+					if err != nil {
+						return nil, err
+					}
+					for _, id := range descendants {
+						if id == keepID {
+							return nil, fiber.NewError(422, "The todo to keep is nested under a removed one")
+						}
+					}
+				}
+				if locked, err := lockedDescendants(sc, removedID); err != nil {
+					return nil, err
+				} else if locked {
+					return nil, fiber.NewError(423, "Some of the todos nested under the removed ones are locked")
+				}
+			}
+			if _, err := collection.DeleteMany(sc, removeFilter); err != nil {
+				return nil, err
+			}
+			// children move up past the removed todos, to the closest remaining ancestor
+			parents := make(map[string]*primitive.ObjectID, len(removed))
+			for _, todo := range removed {
+				parents[todo.ID] = todo.ParentID
+			}
+			for i := range removed {
+				parent := removed[i].ParentID
+				for hops := 0; parent != nil && hops < len(removed); hops++ {
+					next, ok := parents[parent.Hex()]
+					if !ok {
+						break
+					}
+					parent = next
+				}
+				removed[i].ParentID = parent
+				if err := removeChildren(sc, &removed[i]); err != nil {
+					return nil, err
+				}
+			}
+			// the kept todo itself may have been moved up to a new parent
+			reread := &Todo{}
+			if err := collection.FindOne(sc, bson.D{{Key: "_id", Value: keepID}}).Decode(reread); err != nil {
+				return nil, err
+			}
+			return reread, nil
+		})
+		if err != nil {
+			if _, ok := err.(*fiber.Error); ok {
+				return err
+			}
+			return c.Status(500).SendString(err.Error())
+		}
+
+		return c.JSON(merged)
+	})
+
+	// Move every overdue incomplete todo to a new due date
+	// Docs: https://docs.mongodb.com/manual/reference/method/db.collection.updateMany/
+	app.Post("/reschedule-overdue", allowQuery(), func(c *fiber.Ctx) error {
+		request := new(RescheduleRequest)
+		if err := c.BodyParser(request); err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		if (request.To == nil) == (request.By == "") {
+			return c.Status(400).SendString("Exactly one of to or by is required")
+		}
+
+		now := time.Now().UTC()
+		target := request.To
+		if request.By != "" {
+			offset, err := parseOffset(request.By)
+			if err != nil {
+				return c.Status(400).SendString("by must be a valid offset")
+			}
+			to := now.Add(offset)
+			target = &to
+		}
+		if !target.After(now) {
+			return c.Status(422).SendString("The new due date must be in the future")
+		}
+
+		// locked todos keep their due date
+		filter := bson.D{
+			{Key: "completed", Value: false},
+			{Key: "dueDate", Value: bson.D{{Key: "$lt", Value: now}}},
+			notLocked,
+		}
+		fields := bson.D{
+			{Key: "dueDate", Value: target.UTC()},
+			{Key: "updatedAt", Value: now},
+		}
+		if config.FieldTimestamps {
+			fields = append(fields, bson.E{Key: "fieldUpdatedAt.dueDate", Value: now})
+		}
+		update := bson.D{{Key: "$set", Value: fields}}
+		result, err := mg.Db.Collection("todos").UpdateMany(c.Context(), filter, update)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+
+		return c.JSON(fiber.Map{"modified": result.ModifiedCount})
+	})
+
+	// Get the incomplete todos with a due date as an iCalendar feed
+	// Docs: https://datatracker.ietf.org/doc/html/rfc5545#section-3.6.2
+	app.Get("/calendar.ics", allowQuery(), func(c *fiber.Ctx) error {
+		query := bson.D{
+			{Key: "completed", Value: false},
+			{Key: "dueDate", Value: bson.D{{Key: "$exists", Value: true}}},
+		}
+		opts := options.Find().SetSort(bson.D{{Key: "dueDate", Value: 1}})
+		cursor, err := mg.Db.Collection("todos").Find(c.Context(), query, opts)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+
+		var todos []Todo
+		if err := cursor.All(c.Context(), &todos); err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+
+		now := time.Now().UTC()
+		b := &strings.Builder{}
+		writeICSLine(b, "BEGIN:VCALENDAR")
+		writeICSLine(b, "VERSION:2.0")
+		writeICSLine(b, "PRODID:-//golang-todos-api//todos//EN")
+		for _, todo := range todos {
+			stamp := now
+			if todo.UpdatedAt != nil {
+				stamp = *todo.UpdatedAt
+			}
+			writeICSLine(b, "BEGIN:VTODO")
+			writeICSLine(b, "UID:"+todo.ID+"@golang-todos-api")
+			writeICSLine(b, "DTSTAMP:"+stamp.UTC().Format(icsTimeFormat))
+			writeICSLine(b, "SUMMARY:"+icsEscaper.Replace(todo.Text))
+			writeICSLine(b, "DUE:"+todo.DueDate.UTC().Format(icsTimeFormat))
+			writeICSLine(b, "STATUS:NEEDS-ACTION")
+			if len(todo.Tags) > 0 {
+				categories := make([]string, 0, len(todo.Tags))
+				for _, tag := range todo.Tags {
+					categories = append(categories, icsEscaper.Replace(tag))
+				}
+				writeICSLine(b, "CATEGORIES:"+strings.Join(categories, ","))
+			}
+			writeICSLine(b, "END:VTODO")
+		}
+		writeICSLine(b, "END:VCALENDAR")
+
+		c.Set(fiber.HeaderContentType, "text/calendar; charset=utf-8")
+		return c.SendString(b.String())
+	})
+
+	// Get the most recently created todos as an RSS 2.0 feed
+	// Docs: https://www.rssboard.org/rss-specification
+	app.Get("/feed.rss", allowQuery(), func(c *fiber.Ctx) error {
+		// ObjectIDs start with their creation time, so they sort newest first
+		opts := options.Find().
+			SetSort(bson.D{{Key: "_id", Value: -1}}).
+			SetLimit(config.FeedSize)
+		cursor, err := mg.Db.Collection("todos").Find(c.Context(), bson.D{}, opts)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+
+		var todos []Todo
+		if err := cursor.All(c.Context(), &todos); err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+
+		feed := RSS{
+			Version: "2.0",
+			Channel: RSSChannel{
+				Title:       "Todos",
+				Link:        c.BaseURL() + "/",
+				Description: "The most recently created todos",
+				Items:       make([]RSSItem, 0, len(todos)),
+			},
+		}
+		for _, todo := range todos {
+			created := time.Now().UTC()
+			if todo.CreatedAt != nil {
+				created = *todo.CreatedAt
+			} else if id, err := primitive.ObjectIDFromHex(todo.ID); err == nil {
+				created = id.Timestamp()
+			}
+
+			description := todo.Text
+			if todo.Completed {
+				description += " (completed)"
+			}
+			if len(todo.Tags) > 0 {
+				description += " [" + strings.Join(todo.Tags, ", ") + "]"
+			}
+
+			feed.Channel.Items = append(feed.Channel.Items, RSSItem{
+				Title:       todo.Text,
+				Description: description,
+				PubDate:     created.Format(time.RFC1123Z),
+				GUID:        RSSGUID{Value: todo.ID},
+			})
+		}
+
+		data, err := xml.Marshal(feed)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		c.Set(fiber.HeaderContentType, "application/rss+xml; charset=utf-8")
+		return c.Send(append([]byte(xml.Header), data...))
+	})
+
+	// Get the todos completed within a date range, most recent first
+	app.Get("/completed", allowQuery("from", "to", "tz", "limit", "offset"), func(c *fiber.Ctx) error {
+		loc, err := resolveTimezone(c)
+		if err != nil {
+			return err
+		}
+		completedAt, err := queryRange(c, loc)
+		if err != nil {
+			return err
+		}
+		limit, err := queryLimit(c, config.DefaultPageSize, config.MaxPageSize)
+		if err != nil {
+			return err
+		}
+		offset, err := queryOffset(c)
+		if err != nil {
+			return err
+		}
+
+		query := bson.D{
+			{Key: "completed", Value: true},
+			{Key: "completedAt", Value: completedAt},
+		}
+		opts := options.Find().
+			SetSort(bson.D{{Key: "completedAt", Value: -1}, {Key: "_id", Value: -1}}).
+			SetSkip(offset).
+			SetLimit(limit)
+		todos, err := findTodos(c.Context(), query, opts)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.JSON(todos)
+	})
+
+	// Get the most recently completed todos
+	// Docs: https://docs.mongodb.com/manual/reference/method/cursor.sort/
+	app.Get("/recent-completed", allowQuery("limit"), func(c *fiber.Ctx) error {
+		limit, err := queryLimit(c, 10, 100)
+		if err != nil {
+			return err
+		}
+
+		query := bson.D{
+			{Key: "completed", Value: true},
+			{Key: "completedAt", Value: bson.D{{Key: "$exists", Value: true}}},
+		}
+		opts := options.Find().
+			SetSort(bson.D{{Key: "completedAt", Value: -1}}).
+			SetLimit(limit)
+		cursor, err := mg.Db.Collection("todos").Find(c.Context(), query, opts)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+
+		var todos []Todo = make([]Todo, 0)
+		if err := cursor.All(c.Context(), &todos); err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.JSON(todos)
+	})
+
+	// Rename a tag on every todo carrying it, locked todos keep their tags
+	// Docs: https://docs.mongodb.com/manual/reference/operator/aggregation/reduce/
+	app.Post("/tags/rename", allowQuery(), func(c *fiber.Ctx) error {
+		request := new(TagRenameRequest)
+		if err := c.BodyParser(request); err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		from, to := strings.TrimSpace(request.From), strings.TrimSpace(request.To)
+		if from == "" || to == "" {
+			return c.Status(422).SendString("Both from and to are required")
+		}
+		if from == to {
+			return c.Status(422).SendString("from and to must differ")
+		}
+
+		// replace the tag in place, dropping it instead when the todo already
+		// carries the new one, so that the order of the tags is kept
+		renamed := bson.D{{Key: "$map", Value: bson.D{
+			{Key: "input", Value: "$tags"},
+			{Key: "in", Value: bson.D{{Key: "$cond", Value: bson.A{
+				bson.D{{Key: "$eq", Value: bson.A{"$$this", from}}}, to, "$$this",
+			}}}},
+		}}}
+		deduped := bson.D{{Key: "$reduce", Value: bson.D{
+			{Key: "input", Value: renamed},
+			{Key: "initialValue", Value: bson.A{}},
+			{Key: "in", Value: bson.D{{Key: "$cond", Value: bson.A{
+				bson.D{{Key: "$in", Value: bson.A{"$$this", "$$value"}}},
+				"$$value",
+				bson.D{{Key: "$concatArrays", Value: bson.A{"$$value", bson.A{"$$this"}}}},
+			}}}},
+		}}}
+
+		now := time.Now().UTC()
+		fields := bson.D{
+			{Key: "tags", Value: deduped},
+			{Key: "updatedAt", Value: now},
+		}
+		if config.FieldTimestamps {
+			fields = append(fields, bson.E{Key: "fieldUpdatedAt.tags", Value: now})
+		}
+		filter := bson.D{{Key: "tags", Value: from}, notLocked}
+		update := mongo.Pipeline{{{Key: "$set", Value: fields}}}
+		result, err := mg.Db.Collection("todos").UpdateMany(c.Context(), filter, update)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.JSON(fiber.Map{"modified": result.ModifiedCount})
+	})
+
+	// Get the most used tags with the number of todos carrying them
+	// Docs: https://docs.mongodb.com/manual/reference/operator/aggregation/group/
+	app.Get("/tags/top", allowQuery("limit"), func(c *fiber.Ctx) error {
+		limit, err := queryLimit(c, 10, config.MaxPageSize)
+		if err != nil {
+			return err
+		}
+
+		pipeline := mongo.Pipeline{
+			{{Key: "$unwind", Value: "$tags"}},
+			{{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: "$tags"},
+				{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			}}},
+			{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+			{{Key: "$limit", Value: limit}},
+			{{Key: "$project", Value: bson.D{
+				{Key: "_id", Value: 0},
+				{Key: "tag", Value: "$_id"},
+				{Key: "count", Value: 1},
+			}}},
+		}
+
+		cursor, err := mg.Db.Collection("todos").Aggregate(c.Context(), pipeline)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+
+		tags := make([]struct {
+			Tag   string `json:"tag" bson:"tag"`
+			Count int    `json:"count" bson:"count"`
+		}, 0)
+		if err := cursor.All(c.Context(), &tags); err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.JSON(tags)
+	})
+
+	// Preview the tags the auto tagging rules would add to a text or to an
+	// existing todo, without saving anything
+	app.Post("/tags/preview", allowQuery(), func(c *fiber.Ctx) error {
+		var request struct {
+			Text string `json:"text"`
+			ID   string `json:"id"`
+		}
+		if err := c.BodyParser(&request); err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		if (request.Text == "") == (request.ID == "") {
+			return c.Status(400).SendString("Exactly one of text or id is required")
+		}
+
+		text, existing := request.Text, []string(nil)
+		if request.ID != "" {
+			todoID, err := primitive.ObjectIDFromHex(request.ID)
+			if err != nil {
+				return c.SendStatus(400)
+			}
+			todo := &Todo{}
+			if err := mg.Db.Collection("todos").FindOne(c.Context(), bson.D{{Key: "_id", Value: todoID}}).Decode(todo); err != nil {
+				if err == mongo.ErrNoDocuments {
+					return c.SendStatus(404)
+				}
+				return c.SendStatus(500)
+			}
+			text, existing = todo.Text, todo.Tags
+		}
+
+		// only report the tags the todo doesn't carry yet
+		has := make(map[string]bool, len(existing))
+		for _, tag := range existing {
+			has[tag] = true
+		}
+		added := make([]string, 0)
+		for _, tag := range sanitizeTags(autoTags(text)) {
+			if !has[tag] {
+				added = append(added, tag)
+			}
+		}
+		return c.JSON(fiber.Map{"tags": added})
+	})
+
+	// Remove a tag from every todo carrying it, locked todos keep their tags
+	app.Delete("/tags/:tag", allowQuery(), func(c *fiber.Ctx) error {
+		// tags may contain spaces and such, sent percent-encoded
+		tag, err := url.PathUnescape(c.Params("tag"))
+		if err != nil {
+			return c.SendStatus(400)
+		}
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			return c.SendStatus(400)
+		}
+
+		now := time.Now().UTC()
+		fields := bson.D{{Key: "updatedAt", Value: now}}
+		if config.FieldTimestamps {
+			fields = append(fields, bson.E{Key: "fieldUpdatedAt.tags", Value: now})
+		}
+		filter := bson.D{{Key: "tags", Value: tag}, notLocked}
+		update := bson.D{
+			{Key: "$pull", Value: bson.D{{Key: "tags", Value: tag}}},
+			{Key: "$set", Value: fields},
+		}
+		result, err := mg.Db.Collection("todos").UpdateMany(c.Context(), filter, update)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.JSON(fiber.Map{"modified": result.ModifiedCount})
+	})
+
+	// Get the distinct tags in use, optionally only those starting with a prefix
+	// Docs: https://docs.mongodb.com/manual/reference/operator/aggregation/unwind/
+	app.Get("/tags", allowQuery("prefix"), func(c *fiber.Ctx) error {
+		pipeline := mongo.Pipeline{
+			{{Key: "$unwind", Value: "$tags"}},
+		}
+		if prefix := c.Query("prefix"); prefix != "" {
+			// the prefix is user input, so escape any regex metacharacters
+			pattern := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(prefix), Options: "i"}
+			pipeline = append(pipeline, bson.D{{Key: "$match", Value: bson.D{{Key: "tags", Value: pattern}}}})
+		}
+		pipeline = append(pipeline,
+			bson.D{{Key: "$group", Value: bson.D{{Key: "_id", Value: "$tags"}}}},
+			bson.D{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+		)
+
+		cursor, err := mg.Db.Collection("todos").Aggregate(c.Context(), pipeline)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+
+		var groups []struct {
+			Tag string `bson:"_id"`
+		}
+		if err := cursor.All(c.Context(), &groups); err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+
+		tags := make([]string, 0, len(groups))
+		for _, group := range groups {
+			tags = append(tags, group.Tag)
+		}
+		return c.JSON(tags)
+	})
+
+	// Get the priorities in use, from lowest to highest
+	// Docs: https://docs.mongodb.com/manual/reference/method/db.collection.distinct/
+	app.Get("/priorities", allowQuery(), func(c *fiber.Ctx) error {
+		values, err := mg.Db.Collection("todos").Distinct(c.Context(), "priority", bson.D{})
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+
+		used := make(map[string]bool, len(values))
+		for _, value := range values {
+			if priority, ok := value.(string); ok {
+				used[priority] = true
+			}
+		}
+
+		inUse := make([]string, 0, len(priorities))
+		for _, priority := range priorities {
+			if used[priority] {
+				inUse = append(inUse, priority)
+			}
+		}
+		return c.JSON(inUse)
+	})
+
+	// Get all the todos nested under their parents
+	app.Get("/tree", allowQuery(), func(c *fiber.Ctx) error {
+		todos, err := findTodos(c.Context(), bson.D{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.JSON(buildTree(todos))
+	})
+
+	// Get the server's clock in its configured timezone, to detect clock skew
+	app.Get("/time", allowQuery(), func(c *fiber.Ctx) error {
+		now := time.Now().In(config.Timezone)
+		return c.JSON(fiber.Map{
+			"now":        now.Format(time.RFC3339Nano),
+			"timezone":   config.Timezone.String(),
+			"unixMillis": now.UnixMilli(),
+		})
+	})
+
+	// Get a checksum that changes whenever the todos do
+	app.Get("/checksum", allowQuery(), func(c *fiber.Ctx) error {
+		checksum, err := collectionChecksum(c.Context())
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.JSON(fiber.Map{"checksum": checksum})
+	})
+
+	// Describe the fields of a Todo
+	app.Get("/schema", allowQuery(), func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{
+			"name":   "Todo",
+			"fields": describeModel(Todo{}),
+		})
+	})
+
+	// Count the todos matching the list filters
+	// Docs: https://docs.mongodb.com/manual/reference/method/db.collection.countDocuments/
+	app.Get("/count", allowQuery(filterParams()...), func(c *fiber.Ctx) error {
+		query, err := buildFilter(c)
+		if err != nil {
+			return err
+		}
+
+		count, err := mg.Db.Collection("todos").CountDocuments(c.Context(), query)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.JSON(fiber.Map{"count": count})
+	})
+
+	// Export the todos matching the list filters as newline delimited JSON
+	app.Get("/export", allowQuery(filterParams()...), func(c *fiber.Ctx) error {
+		query, err := buildFilter(c)
+		if err != nil {
+			return err
+		}
+
+		// the stream outlives the handler, so it can't use the request context
+		opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+		cursor, err := mg.Db.Collection("todos").Find(context.Background(), query, opts)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return streamNDJSON(c, cursor)
+	})
+
+	// Export the todos matching the list filters as a CSV download, all of
+	// them unless the client asks for a page
+	app.Get("/export.csv", allowQuery(filterParams("limit", "offset")...), func(c *fiber.Ctx) error {
+		query, err := buildFilter(c)
+		if err != nil {
+			return err
+		}
+		limit, err := queryLimit(c, 0, math.MaxInt64)
+		if err != nil {
+			return err
+		}
+		offset, err := queryOffset(c)
+		if err != nil {
+			return err
+		}
+
+		filename := "todos-" + time.Now().In(config.Timezone).Format("2006-01-02") + ".csv"
+		c.Set(fiber.HeaderContentDisposition, `attachment; filename="`+filename+`"`)
+
+		// the stream outlives the handler, so it can't use the request context
+		opts := options.Find().
+			SetSort(bson.D{{Key: "_id", Value: 1}}).
+			SetSkip(offset).
+			SetLimit(limit)
+		cursor, err := mg.Db.Collection("todos").Find(context.Background(), query, opts)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return streamCSV(c, cursor)
+	})
+
+	// Get the todos within a radius of a point, nearest first
+	// Docs: https://docs.mongodb.com/manual/reference/operator/query/near/
+	app.Get("/near", allowQuery("lng", "lat", "maxMeters", "limit"), func(c *fiber.Ctx) error {
+		lng, err := strconv.ParseFloat(c.Query("lng"), 64)
+		if err != nil {
+			return c.Status(400).SendString("lng must be a number")
+		}
+		lat, err := strconv.ParseFloat(c.Query("lat"), 64)
+		if err != nil {
+			return c.Status(400).SendString("lat must be a number")
+		}
+		if !validCoordinates(lng, lat) {
+			return c.Status(400).SendString("lng must be within [-180, 180] and lat within [-90, 90]")
+		}
+		maxMeters := 1000.0
+		if raw := c.Query("maxMeters"); raw != "" {
+			maxMeters, err = strconv.ParseFloat(raw, 64)
+			if err != nil || maxMeters <= 0 {
+				return c.Status(400).SendString("maxMeters must be a positive number")
+			}
+		}
+		limit, err := queryLimit(c, config.DefaultPageSize, config.MaxPageSize)
+		if err != nil {
+			return err
+		}
+
+		query := bson.D{{Key: "location", Value: bson.D{{Key: "$near", Value: bson.D{
+			{Key: "$geometry", Value: GeoPoint{Type: "Point", Coordinates: []float64{lng, lat}}},
+			{Key: "$maxDistance", Value: maxMeters},
+		}}}}}
+		cursor, err := mg.Db.Collection("todos").Find(c.Context(), query, options.Find().SetLimit(limit))
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+
+		var todos []Todo = make([]Todo, 0)
+		if err := cursor.All(c.Context(), &todos); err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.JSON(todos)
+	})
+
+	// Search the text and the tags of the todos at once, the text for the query
+	// anywhere in it and the tags for the query as a whole, ignoring case
+	app.Get("/search/all", allowQuery("q", "limit", "offset"), func(c *fiber.Ctx) error {
+		q := strings.TrimSpace(c.Query("q"))
+		if q == "" {
+			return c.Status(400).SendString("q is required")
+		}
+		limit, err := queryLimit(c, config.DefaultPageSize, config.MaxPageSize)
+		if err != nil {
+			return err
+		}
+		offset, err := queryOffset(c)
+		if err != nil {
+			return err
+		}
+
+		// the query is user input, so escape any regex metacharacters
+		inText := primitive.Regex{Pattern: regexp.QuoteMeta(q), Options: "i"}
+		isTag := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(q) + "$", Options: "i"}
+		query := bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "text", Value: inText}},
+			bson.D{{Key: "tags", Value: isTag}},
+		}}}
+		opts := options.Find().
+			SetSort(bson.D{{Key: "_id", Value: 1}}).
+			SetSkip(offset).
+			SetLimit(limit)
+		todos, err := findTodos(c.Context(), query, opts)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+
+		// a todo matching in several fields is listed once, naming all of them
+		lower := strings.ToLower(q)
+		results := make([]SearchResult, 0, len(todos))
+		for _, todo := range todos {
+			result := SearchResult{Todo: todo, MatchedIn: []string{}}
+			if strings.Contains(strings.ToLower(todo.Text), lower) {
+				result.MatchedIn = append(result.MatchedIn, "text")
+			}
+			for _, tag := range todo.Tags {
+				if strings.EqualFold(tag, q) {
+					result.MatchedIn = append(result.MatchedIn, "tags")
+					break
+				}
+			}
+			results = append(results, result)
+		}
+		return c.JSON(results)
+	})
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+	// Get the overdue incomplete todos that also match the list filters,
+	// such as ?tag=work, the most overdue first
+	app.Get("/overdue", allowQuery(filterParams("limit", "offset")...), func(c *fiber.Ctx) error {
+		limit, err := queryLimit(c, config.DefaultPageSize, config.MaxPageSize)
+		if err != nil {
+			return err
+		}
+		offset, err := queryOffset(c)
+		if err != nil {
+			return err
+		}
+		filters, err := buildFilter(c)
+		if err != nil {
+			return err
+		}
 
-	err = client.Connect(ctx)
-	db := client.Database(dbName)
+		// the list filters are ANDed as a whole so that they can't override
+		// the overdue conditions, e.g. with ?completed=true
+		query := bson.D{{Key: "$and", Value: bson.A{
+			bson.D{
+				{Key: "completed", Value: false},
+				{Key: "dueDate", Value: bson.D{{Key: "$lt", Value: time.Now().UTC()}}},
+			},
+			filters,
+		}}}
+		opts := options.Find().
+			SetSort(bson.D{{Key: "dueDate", Value: 1}, {Key: "_id", Value: 1}}).
+			SetSkip(offset).
+			SetLimit(limit)
+		todos, err := findTodos(c.Context(), query, opts)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.JSON(todos)
+	})
 
-	if err != nil {
-		return err
-	}
+	// Get the most urgent incomplete todos, see urgencyScore for the ranking
+	// Docs: https://docs.mongodb.com/manual/reference/operator/aggregation/addFields/
+	app.Get("/inbox", allowQuery("limit"), func(c *fiber.Ctx) error {
+		limit, err := queryLimit(c, config.DefaultPageSize, config.MaxPageSize)
+		if err != nil {
+			return err
+		}
 
-	mg = MongoInstance{
-		Client: client,
-		Db:     db,
-	}
+		pipeline := mongo.Pipeline{
+			{{Key: "$match", Value: bson.D{{Key: "completed", Value: false}}}},
+			{{Key: "$addFields", Value: bson.D{{Key: "urgency", Value: urgencyScore(time.Now().UTC())}}}},
+			{{Key: "$sort", Value: bson.D{{Key: "urgency", Value: -1}, {Key: "_id", Value: 1}}}},
+			{{Key: "$limit", Value: limit}},
+		}
+		cursor, err := mg.Db.Collection("todos").Aggregate(c.Context(), pipeline)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
 
-	return nil
-}
+		todos := make([]ScoredTodo, 0)
+		if err := cursor.All(c.Context(), &todos); err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.JSON(todos)
+	})
 
-func main() {
-	// Connect to the database
-	if err := Connect(); err != nil {
-		log.Fatal(err)
-	}
+	// Get a summary of the day: what is due today, what is overdue and what
+	// was completed yesterday
+	app.Get("/digest", allowQuery("tz"), func(c *fiber.Ctx) error {
+		loc, err := resolveTimezone(c)
+		if err != nil {
+			return err
+		}
 
-	// Create a Fiber app
-	app := fiber.New()
+		today := startOfDay(time.Now(), loc)
+		tomorrow := today.AddDate(0, 0, 1)
+		yesterday := today.AddDate(0, 0, -1)
+		sorted := func(field string, order int) *options.FindOptions {
+			return options.Find().SetSort(bson.D{{Key: field, Value: order}}).SetLimit(config.MaxPageSize)
+		}
 
-	// Get all todos records from MongoDB
-	// Docs: https://docs.mongodb.com/manual/reference/command/find/
-	app.Get("/", func(c *fiber.Ctx) error {
-		// get all records as a cursor
-		query := bson.D{{}}
-		cursor, err := mg.Db.Collection("todos").Find(c.Context(), query)
+		sections := []struct {
+			name   string
+			filter bson.D
+			opts   *options.FindOptions
+		}{
+			{"dueToday", bson.D{
+				{Key: "completed", Value: false},
+				{Key: "dueDate", Value: bson.D{{Key: "$gte", Value: today}, {Key: "$lt", Value: tomorrow}}},
+			}, sorted("dueDate", 1)},
+			{"overdue", bson.D{
+				{Key: "completed", Value: false},
+				{Key: "dueDate", Value: bson.D{{Key: "$lt", Value: today}}},
+			}, sorted("dueDate", 1)},
+			{"completedYesterday", bson.D{
+				{Key: "completed", Value: true},
+				{Key: "completedAt", Value: bson.D{{Key: "$gte", Value: yesterday}, {Key: "$lt", Value: today}}},
+			}, sorted("completedAt", -1)},
+		}
+
+		// the lists are capped, so the counts are computed separately
+		digest := fiber.Map{}
+		counts := fiber.Map{}
+		for _, section := range sections {
+			todos, err := findTodos(c.Context(), section.filter, section.opts)
+			if err != nil {
+				return c.Status(500).SendString(err.Error())
+			}
+			count, err := mg.Db.Collection("todos").CountDocuments(c.Context(), section.filter)
+			if err != nil {
+				return c.Status(500).SendString(err.Error())
+			}
+			digest[section.name] = todos
+			counts[section.name] = count
+		}
+		digest["counts"] = counts
+		return c.JSON(digest)
+	})
+
+	// Get the incomplete todos bucketed by due date: overdue, today, tomorrow,
+	// the rest of the week (weeks end on Sunday), later and without a due date
+	app.Get("/agenda", allowQuery("tz"), func(c *fiber.Ctx) error {
+		loc, err := resolveTimezone(c)
 		if err != nil {
-			return c.Status(500).SendString(err.Error())
+			return err
 		}
 
-		var todos []Todo = make([]Todo, 0)
+		today := startOfDay(time.Now(), loc)
+		tomorrow := today.AddDate(0, 0, 1)
+		dayAfter := today.AddDate(0, 0, 2)
+		nextWeek := today.AddDate(0, 0, (8-int(today.Weekday()))%7)
+		if !nextWeek.After(today) {
+			nextWeek = today.AddDate(0, 0, 7)
+		}
+		// on Saturdays and Sundays nothing is left of the week after tomorrow
+		if nextWeek.Before(dayAfter) {
+			nextWeek = dayAfter
+		}
 
-		// iterate the cursor and decode each item into an Employee
-		if err := cursor.All(c.Context(), &todos); err != nil {
-			return c.Status(500).SendString(err.Error())
+		opts := func() *options.FindOptions {
+			return options.Find().SetSort(bson.D{{Key: "dueDate", Value: 1}, {Key: "_id", Value: 1}}).SetLimit(config.MaxPageSize)
+		}
+		due := func(bounds bson.D) bson.D {
+			return bson.D{{Key: "completed", Value: false}, {Key: "dueDate", Value: bounds}}
+		}
+		buckets := []struct {
+			name   string
+			filter bson.D
+		}{
+			{"overdue", due(bson.D{{Key: "$lt", Value: today}})},
+			{"today", due(bson.D{{Key: "$gte", Value: today}, {Key: "$lt", Value: tomorrow}})},
+			{"tomorrow", due(bson.D{{Key: "$gte", Value: tomorrow}, {Key: "$lt", Value: dayAfter}})},
+			{"thisWeek", due(bson.D{{Key: "$gte", Value: dayAfter}, {Key: "$lt", Value: nextWeek}})},
+			{"later", due(bson.D{{Key: "$gte", Value: nextWeek}})},
+			// null also matches todos without a dueDate field
+			{"noDate", bson.D{{Key: "completed", Value: false}, {Key: "dueDate", Value: nil}}},
+		}
 
+		agenda := make(fiber.Map, len(buckets))
+		for _, bucket := range buckets {
+			todos, err := findTodos(c.Context(), bucket.filter, opts())
+			if err != nil {
+				return c.Status(500).SendString(err.Error())
+			}
+			agenda[bucket.name] = todos
 		}
-		// return employees list in JSON format
-		return c.JSON(todos)
+		return c.JSON(agenda)
 	})
 
-	// Insert a new employee into MongoDB
-	// Docs: https://docs.mongodb.com/manual/reference/command/insert/
-	app.Post("/", func(c *fiber.Ctx) error {
+	// Count the todos matching several named filters at once
+	app.Post("/counts", allowQuery(), func(c *fiber.Ctx) error {
+		var requests []NamedCount
+		if err := c.BodyParser(&requests); err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		if len(requests) > maxNamedCounts {
+			return c.Status(413).SendString(fmt.Sprintf("At most %d filters can be counted at once", maxNamedCounts))
+		}
+
+		allowed := make(map[string]bool, len(listFilters))
+		for _, key := range listFilters {
+			allowed[key] = true
+		}
+		filters := make([]bson.D, len(requests))
+		seen := make(map[string]bool, len(requests))
+		for i, request := range requests {
+			if request.Name == "" || seen[request.Name] {
+				return c.Status(400).SendString("Every filter needs a unique name")
+			}
+			seen[request.Name] = true
+			for key := range request.Filter {
+				if !allowed[key] {
+					return c.Status(400).SendString(fmt.Sprintf("%s: unknown filter %s", request.Name, key))
+				}
+			}
+
+			values := request.Filter
+			filter, err := buildFilterFrom(func(key string) string {
+				if value, ok := values[key]; ok && value != nil {
+					return fmt.Sprint(value)
+				}
+				return ""
+			})
+			if err != nil {
+				return fiber.NewError(400, request.Name+": "+err.Error())
+			}
+			filters[i] = filter
+		}
+
+		// the counts are independent, so run them in parallel: one worker uses
+		// the request's own database slot, the others only start when a free
+		// slot is available right away
+		counts := make([]int64, len(requests))
+		errs := make([]error, len(requests))
+		jobs := make(chan int, len(filters))
+		for i := range filters {
+			jobs <- i
+		}
+		close(jobs)
+		worker := func() {
+			for i := range jobs {
+				counts[i], errs[i] = mg.Db.Collection("todos").CountDocuments(c.Context(), filters[i])
+			}
+		}
+		var wg sync.WaitGroup
+		for w := 0; w < len(filters); w++ {
+			if w > 0 && !tryAcquireDB() {
+				break
+			}
+			wg.Add(1)
+			go func(extra bool) {
+				defer wg.Done()
+				if extra {
+					defer releaseDB()
+				}
+				worker()
+			}(w > 0)
+		}
+		wg.Wait()
+
+		result := make(fiber.Map, len(requests))
+		for i, request := range requests {
+			if errs[i] != nil {
+				return c.Status(500).SendString(errs[i].Error())
+			}
+			result[request.Name] = counts[i]
+		}
+		return c.JSON(result)
+	})
+
+	// Get the overall completion progress
+	// Docs: https://docs.mongodb.com/manual/reference/method/db.collection.countDocuments/
+	app.Get("/stats/progress", allowQuery(), func(c *fiber.Ctx) error {
 		collection := mg.Db.Collection("todos")
 
-		// New Todo struct
-		todo := new(Todo)
-		// Parse body into struct
-		if err := c.BodyParser(todo); err != nil {
-			return c.Status(400).SendString(err.Error())
+		total, err := collection.CountDocuments(c.Context(), bson.D{})
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		completed, err := collection.CountDocuments(c.Context(), bson.D{{Key: "completed", Value: true}})
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
 		}
 
-		// force MongoDB to always set its own generated ObjectIDs
-		todo.ID = ""
+		// an empty collection has made no progress rather than dividing by zero
+		percent := 0.0
+		if total > 0 {
+			percent = math.Round(float64(completed) * 100 / float64(total))
+		}
 
-		// insert the record
-		insertionResult, err := collection.InsertOne(c.Context(), todo)
+		return c.JSON(fiber.Map{
+			"total":     total,
+			"completed": completed,
+			"percent":   percent,
+		})
+	})
+
+	// Count the tags used by each priority
+	// Docs: https://docs.mongodb.com/manual/reference/operator/aggregation/unwind/
+	app.Get("/stats/tags-by-priority", allowQuery(), func(c *fiber.Ctx) error {
+		pipeline := mongo.Pipeline{
+			{{Key: "$unwind", Value: "$tags"}},
+			{{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: bson.D{
+					{Key: "priority", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$priority", ""}}}},
+					{Key: "tag", Value: "$tags"},
+				}},
+				{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			}}},
+			{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id.tag", Value: 1}}}},
+			{{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: "$_id.priority"},
+				{Key: "tags", Value: bson.D{{Key: "$push", Value: bson.D{
+					{Key: "tag", Value: "$_id.tag"},
+					{Key: "count", Value: "$count"},
+				}}}},
+			}}},
+		}
+
+		cursor, err := mg.Db.Collection("todos").Aggregate(c.Context(), pipeline)
 		if err != nil {
 			return c.Status(500).SendString(err.Error())
 		}
 
-		// get the just inserted record in order to return it as response
-		filter := bson.D{{Key: "_id", Value: insertionResult.InsertedID}}
-		createdRecord := collection.FindOne(c.Context(), filter)
+		type tagCount struct {
+			Tag   string `json:"tag" bson:"tag"`
+			Count int    `json:"count" bson:"count"`
+		}
+		var groups []struct {
+			Priority string     `bson:"_id"`
+			Tags     []tagCount `bson:"tags"`
+		}
+		if err := cursor.All(c.Context(), &groups); err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+
+		byPriority := make(map[string][]tagCount, len(groups))
+		for _, group := range groups {
+			byPriority[group.Priority] = group.Tags
+		}
 
-		// decode the Mongo record into Todo
-		createdTodo := &Todo{}
-		createdRecord.Decode(createdTodo)
+		// list the priorities from lowest to highest, todos without one last
+		type priorityTags struct {
+			Priority string     `json:"priority"`
+			Tags     []tagCount `json:"tags"`
+		}
+		result := make([]priorityTags, 0, len(groups))
+		for _, priority := range append(append([]string{}, priorities...), "") {
+			if tags, ok := byPriority[priority]; ok {
+				result = append(result, priorityTags{Priority: priority, Tags: tags})
+			}
+		}
+		return c.JSON(result)
+	})
+
+	// Count the completed todos per ISO week, optionally within a date range
+	// Docs: https://docs.mongodb.com/manual/reference/operator/aggregation/isoWeek/
+	app.Get("/stats/by-week", allowQuery("from", "to", "tz"), func(c *fiber.Ctx) error {
+		loc, err := resolveTimezone(c)
+		if err != nil {
+			return err
+		}
+		completedAt, err := queryRange(c, loc)
+		if err != nil {
+			return err
+		}
+
+		// weeks start on Monday in the resolved timezone
+		date := bson.D{{Key: "date", Value: "$completedAt"}, {Key: "timezone", Value: loc.String()}}
+		pipeline := mongo.Pipeline{
+			{{Key: "$match", Value: bson.D{
+				{Key: "completed", Value: true},
+				{Key: "completedAt", Value: completedAt},
+			}}},
+			{{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: bson.D{
+					{Key: "year", Value: bson.D{{Key: "$isoWeekYear", Value: date}}},
+					{Key: "week", Value: bson.D{{Key: "$isoWeek", Value: date}}},
+				}},
+				{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			}}},
+			{{Key: "$sort", Value: bson.D{{Key: "_id.year", Value: 1}, {Key: "_id.week", Value: 1}}}},
+			{{Key: "$project", Value: bson.D{
+				{Key: "_id", Value: 0},
+				{Key: "year", Value: "$_id.year"},
+				{Key: "week", Value: "$_id.week"},
+				{Key: "count", Value: 1},
+			}}},
+		}
+
+		cursor, err := mg.Db.Collection("todos").Aggregate(c.Context(), pipeline)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+
+		weeks := make([]struct {
+			Year  int `json:"year" bson:"year"`
+			Week  int `json:"week" bson:"week"`
+			Count int `json:"count" bson:"count"`
+		}, 0)
+		if err := cursor.All(c.Context(), &weeks); err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.JSON(weeks)
+	})
+
+	// Get the distribution of the text lengths, in characters
+	// Docs: https://docs.mongodb.com/manual/reference/operator/aggregation/bucket/
+	app.Get("/stats/text-length", allowQuery(), func(c *fiber.Ctx) error {
+		// each bucket holds the lengths from its boundary up to the next one,
+		// the last one everything longer
+		boundaries := []int{0, 10, 25, 50, 100, 250, 500}
+		pipeline := mongo.Pipeline{
+			{{Key: "$bucket", Value: bson.D{
+				{Key: "groupBy", Value: bson.D{{Key: "$strLenCP", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$text", ""}}}}}},
+				{Key: "boundaries", Value: boundaries},
+				{Key: "default", Value: boundaries[len(boundaries)-1]},
+				{Key: "output", Value: bson.D{{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}}}},
+			}}},
+		}
 
-		// return the created Todo in JSON format
-		return c.Status(201).JSON(createdTodo)
+		cursor, err := mg.Db.Collection("todos").Aggregate(c.Context(), pipeline)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		var groups []struct {
+			From  int `bson:"_id"`
+			Count int `bson:"count"`
+		}
+		if err := cursor.All(c.Context(), &groups); err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+
+		// $bucket leaves out the empty buckets, list them all
+		counts := make(map[int]int, len(groups))
+		for _, group := range groups {
+			counts[group.From] += group.Count
+		}
+		type bucket struct {
+			From  int  `json:"from"`
+			To    *int `json:"to"`
+			Count int  `json:"count"`
+		}
+		buckets := make([]bucket, 0, len(boundaries))
+		for i, from := range boundaries {
+			b := bucket{From: from, Count: counts[from]}
+			if i+1 < len(boundaries) {
+				to := boundaries[i+1]
+				b.To = &to
+			}
+			buckets = append(buckets, b)
+		}
+		return c.JSON(buckets)
 	})
 
 	// Find one Todo record by ID
 	// Docs: https://docs.mongodb.com/manual/reference/command/findOne/
-	app.Get("/:id", func(c *fiber.Ctx) error {
+	app.Get("/:id", allowQuery(), func(c *fiber.Ctx) error {
 		id := c.Params("id")
 		todoId, err := primitive.ObjectIDFromHex(id)
 		// the provided ID might be invalid ObjectID
@@ -139,9 +4013,166 @@ func main() {
 		return c.JSON(todo)
 	})
 
+	// Raise or lower the priority of a todo by one level in a single update
+	// Docs: https://docs.mongodb.com/manual/tutorial/update-documents-with-aggregation-pipeline/
+	changePriority := func(step int) fiber.Handler {
+		return func(c *fiber.Ctx) error {
+			todoID, err := primitive.ObjectIDFromHex(c.Params("id"))
+			// the provided ID might be invalid ObjectID
+			if err != nil {
+				return c.SendStatus(400)
+			}
+
+			now := time.Now().UTC()
+			fields := bson.D{
+				{Key: "priority", Value: shiftPriority(step)},
+				{Key: "updatedAt", Value: now},
+			}
+			if config.FieldTimestamps {
+				fields = append(fields, bson.E{Key: "fieldUpdatedAt.priority", Value: now})
+			}
+			update := mongo.Pipeline{{{Key: "$set", Value: fields}}}
+
+			query := bson.D{{Key: "_id", Value: todoID}, notLocked}
+			opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+			updated := &Todo{}
+			err = mg.Db.Collection("todos").FindOneAndUpdate(c.Context(), query, update, opts).Decode(updated)
+			if err != nil {
+				if err == mongo.ErrNoDocuments {
+					return explainUnmatched(c, todoID, 404)
+				}
+				return c.SendStatus(500)
+			}
+			return c.JSON(updated)
+		}
+	}
+	app.Post("/:id/escalate", allowQuery(), changePriority(1))
+	app.Post("/:id/deescalate", allowQuery(), changePriority(-1))
+
+	// Lock or unlock a todo against edits and deletion
+	setLocked := func(locked bool) fiber.Handler {
+		return func(c *fiber.Ctx) error {
+			todoID, err := primitive.ObjectIDFromHex(c.Params("id"))
+			// the provided ID might be invalid ObjectID
+			if err != nil {
+				return c.SendStatus(400)
+			}
+
+			query := bson.D{{Key: "_id", Value: todoID}}
+			update := bson.D{{Key: "$set", Value: bson.D{
+				{Key: "locked", Value: locked},
+				{Key: "updatedAt", Value: time.Now().UTC()},
+			}}}
+			opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+			updated := &Todo{}
+			err = mg.Db.Collection("todos").FindOneAndUpdate(c.Context(), query, update, opts).Decode(updated)
+			if err != nil {
+				if err == mongo.ErrNoDocuments {
+					return c.SendStatus(404)
+				}
+				return c.SendStatus(500)
+			}
+			return c.JSON(updated)
+		}
+	}
+	app.Post("/:id/lock", allowQuery(), setLocked(true))
+	app.Post("/:id/unlock", allowQuery(), setLocked(false))
+
+	// Flag a todo as blocked, with an optional reason, or clear the flag
+	setBlocked := func(blocked bool) fiber.Handler {
+		return func(c *fiber.Ctx) error {
+			todoID, err := primitive.ObjectIDFromHex(c.Params("id"))
+			// the provided ID might be invalid ObjectID
+			if err != nil {
+				return c.SendStatus(400)
+			}
+
+			update := bson.D{}
+			fields := bson.D{
+				{Key: "blocked", Value: blocked},
+				{Key: "updatedAt", Value: time.Now().UTC()},
+			}
+			if blocked {
+				var body struct {
+					Reason string `json:"reason"`
+				}
+				// the reason is optional, so is the body
+				if len(c.Body()) > 0 {
+					if err := c.BodyParser(&body); err != nil {
+						return c.Status(400).SendString(err.Error())
+					}
+				}
+				if reason := strings.TrimSpace(body.Reason); reason != "" {
+					fields = append(fields, bson.E{Key: "blockedReason", Value: reason})
+				} else {
+					update = append(update, bson.E{Key: "$unset", Value: bson.D{{Key: "blockedReason", Value: ""}}})
+				}
+			} else {
+				update = append(update, bson.E{Key: "$unset", Value: bson.D{{Key: "blockedReason", Value: ""}}})
+			}
+			update = append(update, bson.E{Key: "$set", Value: fields})
+
+			query := bson.D{{Key: "_id", Value: todoID}, notLocked}
+			opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+			updated := &Todo{}
+			err = mg.Db.Collection("todos").FindOneAndUpdate(c.Context(), query, update, opts).Decode(updated)
+			if err != nil {
+				if err == mongo.ErrNoDocuments {
+					return explainUnmatched(c, todoID, 404)
+				}
+				return c.SendStatus(500)
+			}
+			return c.JSON(updated)
+		}
+	}
+	app.Post("/:id/block", allowQuery(), setBlocked(true))
+	app.Post("/:id/unblock", allowQuery(), setBlocked(false))
+
+	// Mark a todo as in progress
+	app.Post("/:id/start", allowQuery(), func(c *fiber.Ctx) error {
+		todoID, err := primitive.ObjectIDFromHex(c.Params("id"))
+		// the provided ID might be invalid ObjectID
+		if err != nil {
+			return c.SendStatus(400)
+		}
+
+		query := bson.D{{Key: "_id", Value: todoID}, notLocked}
+		update := statusUpdate(StatusInProgress, time.Now().UTC())
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		updated := &Todo{}
+		err = mg.Db.Collection("todos").FindOneAndUpdate(c.Context(), query, update, opts).Decode(updated)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				return explainUnmatched(c, todoID, 404)
+			}
+			return c.SendStatus(500)
+		}
+		return c.JSON(updated)
+	})
+
+	// Export one Todo record with all of its data
+	app.Get("/:id/export", allowQuery(), func(c *fiber.Ctx) error {
+		todoID, err := primitive.ObjectIDFromHex(c.Params("id"))
+		// the provided ID might be invalid ObjectID
+		if err != nil {
+			return c.SendStatus(400)
+		}
+
+		export := TodoExport{Version: exportVersion, ExportedAt: time.Now().UTC()}
+		filter := bson.D{{Key: "_id", Value: todoID}}
+		err = mg.Db.Collection("todos").FindOne(c.Context(), filter).Decode(&export.Todo)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				return c.SendStatus(404)
+			}
+			return c.SendStatus(500)
+		}
+		return c.JSON(export)
+	})
+
 	// Update an todo record in MongoDB
 	// Docs: https://docs.mongodb.com/manual/reference/command/findAndModify/
-	app.Put("/:id", func(c *fiber.Ctx) error {
+	app.Put("/:id", allowQuery(), trimBody, func(c *fiber.Ctx) error {
 		idParam := c.Params("id")
 		todoID, err := primitive.ObjectIDFromHex(idParam)
 
@@ -155,35 +4186,126 @@ func main() {
 		if err := c.BodyParser(todo); err != nil {
 			return c.Status(400).SendString(err.Error())
 		}
+		if err := validateTodo(todo); err != nil {
+			return err
+		}
+		if err := limitText(c, todo); err != nil {
+			return err
+		}
+
+		// keep the normalized copy in sync with the new text
+		now := time.Now().UTC()
+		todo.NormalizedText = ""
+		todo.Tags = sanitizeTags(append(todo.Tags, autoTags(todo.Text)...))
+
+		// the status moves are guarded like on POST /bulk-status
+		current := &Todo{}
+		err = mg.Db.Collection("todos").FindOne(c.Context(), bson.D{{Key: "_id", Value: todoID}}).Decode(current)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				return c.SendStatus(404)
+			}
+			return c.SendStatus(500)
+		}
+		// older clients only send completed, their toggles skip the transitions
+		namedStatus := todo.Status != ""
+		syncStatus(todo, current)
+		if namedStatus && !canTransition(current.Status, todo.Status) {
+			return c.Status(422).SendString(fmt.Sprintf("cannot move from %s to %s", current.Status, todo.Status))
+		}
+
+		fields := bson.D{
+			{Key: "text", Value: todo.Text},
+			{Key: "completed", Value: todo.Completed},
+			{Key: "status", Value: todo.Status},
+			{Key: "tags", Value: todo.Tags},
+			{Key: "updatedAt", Value: now},
+		}
+		if config.NormalizeText {
+			todo.NormalizedText = normalizeText(todo.Text)
+			fields = append(fields, bson.E{Key: "normalizedText", Value: todo.NormalizedText})
+		}
+		unset := bson.D{}
+		if todo.Priority != "" {
+			fields = append(fields, bson.E{Key: "priority", Value: todo.Priority})
+		} else {
+			unset = append(unset, bson.E{Key: "priority", Value: ""})
+		}
+		if todo.DueDate != nil {
+			fields = append(fields, bson.E{Key: "dueDate", Value: *todo.DueDate})
+		} else {
+			unset = append(unset, bson.E{Key: "dueDate", Value: ""})
+		}
+		if todo.Location != nil {
+			fields = append(fields, bson.E{Key: "location", Value: todo.Location})
+		} else {
+			unset = append(unset, bson.E{Key: "location", Value: ""})
+		}
+		if todo.ParentID != nil {
+			if err := validateParent(c.Context(), &todoID, *todo.ParentID); err != nil {
+				return err
+			}
+			fields = append(fields, bson.E{Key: "parentId", Value: *todo.ParentID})
+		} else {
+			unset = append(unset, bson.E{Key: "parentId", Value: ""})
+		}
+		// reopening a todo clears its completion time
+		if !todo.Completed {
+			unset = append(unset, bson.E{Key: "completedAt", Value: ""})
+		}
 
-		// Find the todo and update its data
-		query := bson.D{{Key: "_id", Value: todoID}}
+		// stamp only the fields that actually change
+		if config.FieldTimestamps {
+			for _, field := range changedFields(current, todo) {
+				fields = append(fields, bson.E{Key: "fieldUpdatedAt." + field, Value: now})
+			}
+		}
+
+		// Find the todo and update its data, unless it is locked or its status
+		// changed since it was checked
+		query := bson.D{{Key: "_id", Value: todoID}, notLocked, {Key: "status", Value: current.Status}}
 		update := bson.D{
-			{Key: "$set",
-				Value: bson.D{
-					{Key: "text", Value: todo.Text},
-					{Key: "completed", Value: todo.Completed},
-				},
-			},
+			{Key: "$set", Value: fields},
 		}
-		err = mg.Db.Collection("todos").FindOneAndUpdate(c.Context(), query, update).Err()
+		if len(unset) > 0 {
+			update = append(update, bson.E{Key: "$unset", Value: unset})
+		}
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		updated := &Todo{}
+		err = mg.Db.Collection("todos").FindOneAndUpdate(c.Context(), query, update, opts).Decode(updated)
 
 		if err != nil {
 			// ErrNoDocuments means that the filter did not match any documents in the collection
 			if err == mongo.ErrNoDocuments {
-				return c.SendStatus(404)
+				return explainUnmatched(c, todoID, 409)
+			}
+			// the new text collides with another todo's normalized text
+			if mongo.IsDuplicateKeyError(err) {
+				return duplicateKey(c, err, todo.NormalizedText)
 			}
 			return c.SendStatus(500)
 		}
 
+		// stamp the completion time only the first time the todo is completed
+		if updated.Completed && updated.CompletedAt == nil {
+			stamp := bson.D{
+				{Key: "_id", Value: todoID},
+				{Key: "completedAt", Value: bson.D{{Key: "$exists", Value: false}}},
+			}
+			set := bson.D{{Key: "$set", Value: bson.D{{Key: "completedAt", Value: now}}}}
+			if _, err := mg.Db.Collection("todos").UpdateOne(c.Context(), stamp, set); err != nil {
+				return c.SendStatus(500)
+			}
+			updated.CompletedAt = &now
+		}
+
 		// return the updated todo
-		todo.ID = idParam
-		return c.Status(200).JSON(todo)
+		return c.Status(200).JSON(updated)
 	})
 
 	// Delete an Todo from MongoDB
 	// Docs: https://docs.mongodb.com/manual/reference/command/delete/
-	app.Delete("/:id", func(c *fiber.Ctx) error {
+	app.Delete("/:id", allowQuery("idempotent"), func(c *fiber.Ctx) error {
 		todoID, err := primitive.ObjectIDFromHex(
 			c.Params("id"),
 		)
@@ -193,22 +4315,86 @@ func main() {
 			return c.SendStatus(400)
 		}
 
-		// find and delete the employee with the given ID
-		query := bson.D{{Key: "_id", Value: todoID}}
-		result, err := mg.Db.Collection("todos").DeleteOne(c.Context(), &query)
+		// idempotent clients may retry, so a todo already gone counts as deleted
+		idempotent := false
+		if raw := c.Query("idempotent"); raw != "" {
+			idempotent, err = strconv.ParseBool(raw)
+			if err != nil {
+				return fiber.NewError(400, "idempotent must be true or false")
+			}
+		}
+
+		// find and delete the employee with the given ID, unless it is locked
+		query := bson.D{{Key: "_id", Value: todoID}, notLocked}
+
+		// only delete the todo if it has not changed since the client last saw it;
+		// HTTP dates have second precision, so anything within that second is fine
+		since := ifUnmodifiedSince(c)
+		if since != nil {
+			query = append(query, bson.E{Key: "$or", Value: bson.A{
+				bson.D{{Key: "updatedAt", Value: bson.D{{Key: "$lt", Value: since.Add(time.Second)}}}},
+				bson.D{{Key: "updatedAt", Value: bson.D{{Key: "$exists", Value: false}}}},
+			}})
+		}
+		// a cascade never deletes locked todos, so neither does their ancestor's deletion
+		locked, err := lockedDescendants(c.Context(), todoID)
+		if err != nil {
+			return c.SendStatus(500)
+		}
+		if locked {
+			return c.Status(423).SendString("Some of the nested todos are locked")
+		}
+
+		deleted := &Todo{}
+		err = mg.Db.Collection("todos").FindOneAndDelete(c.Context(), &query).Decode(deleted)
 
+		// the employee might not exist, be locked or have been modified
+		if err == mongo.ErrNoDocuments {
+			if idempotent {
+				count, err := mg.Db.Collection("todos").CountDocuments(c.Context(), bson.D{{Key: "_id", Value: todoID}})
+				if err != nil {
+					return c.SendStatus(500)
+				}
+				if count == 0 {
+					return c.SendStatus(204)
+				}
+			}
+			if since != nil {
+				return explainUnmatched(c, todoID, 412)
+			}
+			return explainUnmatched(c, todoID, 404)
+		}
 		if err != nil {
 			return c.SendStatus(500)
 		}
 
-		// the employee might not exist
-		if result.DeletedCount < 1 {
-			return c.SendStatus(404)
+		// don't leave the nested todos pointing at a deleted parent
+		if err := removeChildren(c.Context(), deleted); err != nil {
+			return c.SendStatus(500)
 		}
 
 		// the record was deleted
 		return c.SendStatus(204)
 	})
 
-	log.Fatal(app.Listen(":4242"))
+	// drain the in-flight requests on SIGINT or SIGTERM, for a bounded time
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+		<-quit
+
+		log.Printf("Shutting down, waiting up to %s for in-flight requests", config.ShutdownTimeout)
+		if err := app.ShutdownWithTimeout(config.ShutdownTimeout); err != nil {
+			log.Printf("Shutdown timed out, forcing exit: %v", err)
+		} else {
+			log.Print("Shutdown completed cleanly")
+		}
+	}()
+
+	if err := app.Listen(":" + config.Port); err != nil {
+		log.Fatal(err)
+	}
+	<-stopped
 }